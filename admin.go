@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
+)
+
+// scrapeHandler serves POST /-/scrape, which scrapes every target right away,
+// ignoring -fluentd.cache-ttl. With a token, requests have to carry it as
+// "Authorization: Bearer <token>". routes only serves it with -web.admin-token.
+func scrapeHandler(r *reloader, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" {
+			got := []byte(req.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(got, []byte("Bearer " + token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// Concurrently, so hung targets hold up the response for one timeout,
+		// not one each.
+		exporters := r.registry().exporters
+		errs := make([]error, len(exporters))
+		var wg sync.WaitGroup
+		for i, exporter := range exporters {
+			wg.Add(1)
+			go func(i int, exporter *collector.Exporter) {
+				defer wg.Done()
+				errs[i] = exporter.Refresh()
+			}(i, exporter)
+		}
+		wg.Wait()
+
+		var failed []error
+		for _, err := range errs {
+			if err != nil {
+				failed = append(failed, err)
+			}
+		}
+		if len(failed) > 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			for _, err := range failed {
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
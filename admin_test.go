@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeHandler(t *testing.T) {
+	var fetches int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&fetches, 1)
+		fmt.Fprintf(w, `{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":%d,"retry_count":0}]}`, n)
+	}))
+	defer agent.Close()
+	opts := testOpts(agent.URL)
+	// Gathering the metrics would scrape again without the cache, so they
+	// come from the forced scrape.
+	opts.CacheTTL = time.Hour
+	current, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: opts}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	server := httptest.NewServer(scrapeHandler(current, "secret"))
+	defer server.Close()
+
+	post := func(method, auth string) (int, string) {
+		req, err := http.NewRequest(method, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", method, err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if code, _ := post(http.MethodGet, "Bearer secret"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %d, want 405", code)
+	}
+	if code, _ := post(http.MethodPost, ""); code != http.StatusUnauthorized {
+		t.Errorf("POST without the token: %d, want 401", code)
+	}
+	if code, _ := post(http.MethodPost, "Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("POST with a wrong token: %d, want 401", code)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Errorf("rejected requests fetched %d times", n)
+	}
+
+	if code, body := post(http.MethodPost, "Bearer secret"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("POST: %d %q, want 200 ok", code, body)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("POST fetched %d times, want 1", n)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(current.registry().exporters[0])
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP fluentd_buffer_queue_length Number of chunks queued for flushing in the plugin's buffer (buffer_queue_length).
+# TYPE fluentd_buffer_queue_length gauge
+fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""} 1
+`), "fluentd_buffer_queue_length"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrapeHandlerFailure(t *testing.T) {
+	current, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts(downURL())}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	server := httptest.NewServer(scrapeHandler(current, ""))
+	defer server.Close()
+
+	res, err := http.Post(server.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadGateway || !strings.HasPrefix(string(body), "error: ") {
+		t.Errorf("POST with an unreachable agent: %d %q, want 502 and the error", res.StatusCode, body)
+	}
+}
+
+func TestScrapeHandlerConcurrent(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		fmt.Fprint(w, pluginsJSON)
+	}))
+	defer slow.Close()
+	current, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{name: "a", opts: testOpts(slow.URL)}, {name: "b", opts: testOpts(slow.URL)}, {name: "c", opts: testOpts(slow.URL)}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	server := httptest.NewServer(scrapeHandler(current, ""))
+	defer server.Close()
+
+	start := time.Now()
+	res, err := http.Post(server.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("POST: %d, want 200", res.StatusCode)
+	}
+	if took := time.Since(start); took >= 2 * delay {
+		t.Errorf("POST of 3 targets taking %s each took %s, want them scraped concurrently", delay, took)
+	}
+}
+
+func TestScrapeRoute(t *testing.T) {
+	fetched, release := make(chan struct{}, 1), make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		<-release
+		fmt.Fprint(w, pluginsJSON)
+	}))
+	defer agent.Close()
+	current, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts(agent.URL)}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	post := func(mux *http.ServeMux) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/-/scrape", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without a token there is no forced scrape, the landing page answers.
+	mux := http.NewServeMux()
+	if _, err := routes(mux, "", current); err != nil {
+		t.Fatalf("routes: %s", err)
+	}
+	if rec := post(mux); strings.HasPrefix(rec.Body.String(), "ok") || strings.HasPrefix(rec.Body.String(), "error") {
+		t.Errorf("POST /-/scrape without -web.admin-token: %d %q, want no scrape", rec.Code, rec.Body)
+	}
+	select {
+	case <-fetched:
+		t.Error("POST /-/scrape without -web.admin-token fetched")
+	default:
+	}
+
+	oldToken, oldMax := *adminToken, *maxRequests
+	*adminToken, *maxRequests = "secret", 1
+	defer func() { *adminToken, *maxRequests = oldToken, oldMax }()
+	mux = http.NewServeMux()
+	if _, err := routes(mux, "", current); err != nil {
+		t.Fatalf("routes: %s", err)
+	}
+	first := make(chan int)
+	go func() { first <- post(mux).Code }()
+	<-fetched
+
+	// Rejected right away, without waiting for the scrape in flight.
+	if rec := post(mux); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /-/scrape beyond -web.max-requests: %d, want 503", rec.Code)
+	}
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("POST /-/scrape within -web.max-requests: %d, want 200", code)
+	}
+}
@@ -0,0 +1,40 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// AgentConfig is the part of the monitor agent's /api/config.json the
+// exporter exposes. Fields a Fluentd version doesn't report stay empty.
+type AgentConfig struct {
+	ProcessName string          `json:"process_name"`
+	Workers     *float64        `json:"workers"`
+	Version     string          `json:"version"`
+	Pid         *float64        `json:"pid"`
+	StartTime   json.RawMessage `json:"start_time"` // not reported by every version, see parseAgentTime
+
+	Worker string `json:"-"` // set by the Exporter, see Exporter.worker
+}
+
+func (c AgentConfig) workers() string {
+	if c.Workers == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*c.Workers, 'f', -1, 64)
+}
+
+// fetchConfig fetches /api/config.json from endpoint. It returns nil without
+// an error when the agent has no such endpoint.
+func (e *Exporter) fetchConfig(ctx context.Context, endpoint string) (*AgentConfig, error) {
+	var c AgentConfig
+	if _, _, err := e.fetchJSON(ctx, endpoint + "/api/config.json", &c, false); err != nil {
+		if se, ok := err.(*statusError); ok && se.code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &c, nil
+}
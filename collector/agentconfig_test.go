@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newConfigAgent starts a mock monitor agent that also answers
+// /api/config.json with config.
+func newConfigAgent(config string) *httptest.Server {
+	plugins := agentHandler(pluginsJSON)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/config.json" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, config)
+			return
+		}
+		plugins(w, r)
+	}))
+}
+
+func TestConfigInfo(t *testing.T) {
+	agent := newConfigAgent(`{"pid":1234,"ppid":1,"process_name":"aggregator","workers":4,"version":"1.4.2","root_dir":null}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, AgentConfig: true})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_config_info{process_name="aggregator",version="1.4.2",worker="",workers="4"}`: 1,
+	})
+}
+
+func TestConfigInfoNotFound(t *testing.T) {
+	// agentHandler has no /api/config.json.
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, AgentConfig: true})
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("scrape failed on an agent without /api/config.json: %s", err)
+	}
+	if series := seriesOf(collect(t, e.configInfo), "fluentd_config_info"); len(series) != 0 {
+		t.Errorf("got %v without /api/config.json", series)
+	}
+}
+
+func TestWorkerStartAndPid(t *testing.T) {
+	agent := newConfigAgent(`{"pid":1234,"process_name":"aggregator","workers":1,"version":"1.4.2","start_time":"2019-06-01T12:30:15Z"}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, AgentConfig: true})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_worker_pid{worker=""}`:                     1234,
+		`fluentd_worker_start_timestamp_seconds{worker=""}`: 1559392215,
+	})
+}
+
+func TestWorkerStartNotReported(t *testing.T) {
+	agent := newConfigAgent(`{"pid":1234,"process_name":"aggregator","workers":1,"version":"1.4.2"}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, AgentConfig: true})
+	if series := seriesOf(collect(t, e), "fluentd_worker_start_timestamp_seconds"); len(series) != 0 {
+		t.Errorf("got %v from an agent without start_time", series)
+	}
+}
@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// breaker stops fetching from an endpoint for a cooldown once it failed
+// ExporterOpts.FailureThreshold times in a row. After the cooldown a single
+// fetch is let through: success closes the breaker, failure opens it again.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns an error while the breaker is open.
+func (b *breaker) allow(now time.Time) error {
+	if now.Before(b.openUntil) {
+		// Keep the message the same for the whole cooldown, it ends up in
+		// last_scrape_error_info.
+		return &scrapeError{"circuit_open", fmt.Errorf("not fetching during the cooldown after consecutive failures")}
+	}
+	return nil
+}
+
+// record records the outcome of a fetch.
+func (b *breaker) record(err error, now time.Time, threshold int, cooldown time.Duration) {
+	if err == nil {
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = now.Add(cooldown)
+	}
+}
+
+func (b *breaker) open(now time.Time) bool {
+	return now.Before(b.openUntil)
+}
+
+// breakerOpen reports whether the breaker of endpoint is open, never when
+// ExporterOpts.FailureThreshold is not set.
+func (e *Exporter) breakerOpen(endpoint string) bool {
+	b := e.breakers[endpoint]
+	return b != nil && b.open(time.Now())
+}
+
+// fetchGuarded is fetch behind the endpoint's breaker, when
+// ExporterOpts.FailureThreshold is set. Scrapes never run concurrently, so
+// the breakers need no locking.
+func (e *Exporter) fetchGuarded(ctx context.Context, endpoint string) (*PluginsBody, error) {
+	if e.failureThreshold <= 0 {
+		return e.fetch(ctx, endpoint)
+	}
+
+	b, ok := e.breakers[endpoint]
+	if !ok {
+		b = &breaker{}
+		e.breakers[endpoint] = b
+	}
+	if err := b.allow(time.Now()); err != nil {
+		return nil, err
+	}
+	body, err := e.fetch(ctx, endpoint)
+	if ctx.Err() == nil {
+		// A canceled fetch says nothing about the endpoint.
+		b.record(err, time.Now(), e.failureThreshold, e.failureCooldown)
+	}
+	return body, err
+}
+
+// fetchRetrying is fetchGuarded retried up to ExporterOpts.FetchRetries times
+// while it fails. Every attempt counts towards the endpoint's breaker, and
+// once that opens there is nothing left to retry.
+func (e *Exporter) fetchRetrying(ctx context.Context, endpoint string) (*PluginsBody, error) {
+	body, err := e.fetchGuarded(ctx, endpoint)
+	for i := 0; err != nil && i < e.fetchRetries && ctx.Err() == nil && !e.breakerOpen(endpoint); i++ {
+		log.Debugf("Failed to fetch json from %s, retrying. %s", endpoint, err)
+		e.retries.Inc()
+		body, err = e.fetchGuarded(ctx, endpoint)
+	}
+	return body, err
+}
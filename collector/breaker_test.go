@@ -0,0 +1,120 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	failed := &scrapeError{"fetch", nil}
+
+	b.record(failed, now, 2, time.Minute)
+	if err := b.allow(now); err != nil {
+		t.Errorf("open after 1 of 2 failures: %s", err)
+	}
+	b.record(failed, now, 2, time.Minute)
+	first := b.allow(now.Add(time.Second))
+	if first == nil {
+		t.Fatal("closed after 2 of 2 failures")
+	}
+	// The message stays the same while open, see last_scrape_error_info.
+	if second := b.allow(now.Add(30 * time.Second)); second == nil || second.Error() != first.Error() {
+		t.Errorf("allow during the cooldown = %v, want %v", second, first)
+	}
+
+	// Half-open after the cooldown: one failure opens it again.
+	later := now.Add(time.Minute)
+	if err := b.allow(later); err != nil {
+		t.Errorf("open after the cooldown: %s", err)
+	}
+	b.record(failed, later, 2, time.Minute)
+	if !b.open(later) {
+		t.Error("closed after a failed probe")
+	}
+
+	b.record(nil, later.Add(time.Minute), 2, time.Minute)
+	if b.open(later.Add(time.Minute)) || b.failures != 0 {
+		t.Error("still open after a successful probe")
+	}
+}
+
+func TestCircuitOpen(t *testing.T) {
+	var failing, fetches int32 = 1, 0
+	ok := agentHandler(pluginsJSON)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ok(w, r)
+	}))
+	defer agent.Close()
+
+	const cooldown = 100 * time.Millisecond
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, FailureThreshold: 2, FailureCooldown: cooldown})
+	for i := 0; i < 3; i++ {
+		e.Scrape()
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("fetched %d times, want the open breaker to skip the third fetch", n)
+	}
+	if open, failed := testutil.ToFloat64(e.circuitOpen.WithLabelValues("")), testutil.ToFloat64(e.error); open != 1 || failed != 1 {
+		t.Errorf("circuit_open %g, last_scrape_error %g, want 1", open, failed)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(cooldown)
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("probe after the cooldown failed: %s", err)
+	}
+	if open, failed := testutil.ToFloat64(e.circuitOpen.WithLabelValues("")), testutil.ToFloat64(e.error); open != 0 || failed != 0 {
+		t.Errorf("circuit_open %g, last_scrape_error %g, want 0", open, failed)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var fetches int32
+	ok := agentHandler(pluginsJSON)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ok(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, FetchRetries: 3})
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("scrape failed despite retries: %s", err)
+	}
+	if retries := testutil.ToFloat64(e.retries); retries != 2 {
+		t.Errorf("scrape_retries_total %g, want 2", retries)
+	}
+	if errors := testutil.ToFloat64(e.totalErrors); errors != 0 {
+		t.Errorf("scrape_errors_total %g, want 0", errors)
+	}
+}
+
+func TestFetchRetriesStopAtOpenBreaker(t *testing.T) {
+	var fetches int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, FetchRetries: 5, FailureThreshold: 2})
+	e.Scrape()
+	if n, retries := atomic.LoadInt32(&fetches), testutil.ToFloat64(e.retries); n != 2 || retries != 1 {
+		t.Errorf("fetched %d times with scrape_retries_total %g, want 2 fetches and 1 retry", n, retries)
+	}
+}
@@ -0,0 +1,70 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// byteUnit is a unit ExporterOpts.ByteUnit scales byte-valued metrics to.
+type byteUnit struct {
+	divisor float64
+	symbol  string // as written in help texts
+}
+
+// byteUnits are the valid ExporterOpts.ByteUnit values.
+var byteUnits = map[string]byteUnit{
+	"bytes": {1, "bytes"},
+	"kib":   {1 << 10, "KiB"},
+	"mib":   {1 << 20, "MiB"},
+}
+
+// byteMetrics are the byte-valued metrics whose names don't say so.
+var byteMetrics = map[string]bool{
+	"buffer_total_queued_size":     true,
+	"buffer_total_queued_size_all": true,
+}
+
+// isByteMetric reports whether the metric name holds a number of bytes.
+func isByteMetric(name string) bool {
+	return byteMetrics[name] || strings.Contains(name, "bytes")
+}
+
+// parseByteUnit returns the byteUnit of name, bytes when empty.
+func parseByteUnit(name string) (byteUnit, string, error) {
+	if name == "" {
+		name = "bytes"
+	}
+	u, ok := byteUnits[name]
+	if !ok {
+		return byteUnit{}, "", fmt.Errorf("unknown byte unit %q, want bytes, kib or mib", name)
+	}
+	return u, name, nil
+}
+
+// byteMetricName returns the name of the metric name in the exporter's byte
+// unit: with "bytes" replaced by the unit, e.g.
+// buffer_queued_size_growth_mib_per_second, or the unit appended, e.g.
+// buffer_total_queued_size_mib. Other metrics keep their name.
+func (e *Exporter) byteMetricName(name string) string {
+	if e.byteUnitName == "bytes" || !isByteMetric(name) {
+		return name
+	}
+	if strings.Contains(name, "bytes") {
+		return strings.Replace(name, "bytes", e.byteUnitName, 1)
+	}
+	return name + "_" + e.byteUnitName
+}
+
+// byteMetricHelp returns help for the metric name with "in bytes" replaced by
+// the exporter's byte unit. The help of every byte metric says "in bytes".
+func (e *Exporter) byteMetricHelp(name, help string) string {
+	if e.byteUnitName == "bytes" || !isByteMetric(name) {
+		return help
+	}
+	return strings.Replace(help, "in bytes", "in " + e.byteUnit.symbol, 1)
+}
+
+// scaleBytes converts a number of bytes to the exporter's byte unit.
+func (e *Exporter) scaleBytes(v float64) float64 {
+	return v / e.byteUnit.divisor
+}
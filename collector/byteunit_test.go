@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestByteUnitMiB(t *testing.T) {
+	agent := newAgent(`{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_total_queued_size":3145728,"retry_count":0}]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints: []string{agent.URL},
+		Metrics:   []string{"buffer_queue_length", "buffer_total_queued_size"},
+		ByteUnit:  "mib",
+	})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_total_queued_size_mib{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+		`fluentd_buffer_total_queued_size_all_mib{}`:                                         3,
+		// Counts are not bytes.
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+	if series := seriesOf(got, "fluentd_buffer_total_queued_size"); len(series) != 0 {
+		t.Errorf("got %v besides the MiB metric", series)
+	}
+}
+
+func TestByteMetricName(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{ByteUnit: "kib"})
+	for name, want := range map[string]string{
+		"buffer_total_queued_size":                   "buffer_total_queued_size_kib",
+		"buffer_queued_size_growth_bytes_per_second": "buffer_queued_size_growth_kib_per_second",
+		"plugin_buffer_chunk_limit_bytes":            "plugin_buffer_chunk_limit_kib",
+		"buffer_queue_length":                        "buffer_queue_length",
+	} {
+		if got := e.byteMetricName(name); got != want {
+			t.Errorf("byteMetricName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestByteMetricHelp(t *testing.T) {
+	help := map[string]string{}
+	for name, h := range pluginMetricHelp {
+		help[name] = h
+	}
+	for key, g := range configGauges {
+		help[g.name] = g.help(key)
+	}
+	e := newTestExporter(t, ExporterOpts{ByteUnit: "mib"})
+	for name, h := range help {
+		if !isByteMetric(name) {
+			continue
+		}
+		if got := e.byteMetricHelp(name, h); strings.Contains(got, "bytes") || !strings.Contains(got, "in MiB") {
+			t.Errorf("byteMetricHelp(%q) = %q, want it in MiB only", name, got)
+		}
+	}
+}
+
+func TestUnknownByteUnit(t *testing.T) {
+	if _, err := NewExporter(ExporterOpts{ByteUnit: "gib"}); err == nil {
+		t.Error("NewExporter accepted byte unit gib")
+	}
+}
@@ -0,0 +1,200 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// retryConfigKeys are the retry settings exposed by plugin_retry_config_info.
+var retryConfigKeys = []string{"retry_max_interval", "retry_timeout", "retry_wait"}
+
+// configGauge is a numeric plugin setting exposed as a gauge with
+// ExporterOpts.ExposeConfig.
+type configGauge struct {
+	name  string
+	parse func(string) (float64, error)
+}
+
+// configGauges are the settings exposed as gauges, by config key.
+var configGauges = map[string]configGauge{
+	"chunk_limit_size":   {"plugin_buffer_chunk_limit_bytes", parseSizeValue},
+	"total_limit_size":   {"plugin_buffer_total_limit_bytes", parseSizeValue},
+	"queue_limit_length": {"plugin_buffer_queue_limit_length", parseCountValue},
+	"flush_interval":     {"plugin_flush_interval_seconds", parseDurationValue},
+	"flush_thread_count": {"plugin_flush_thread_count", parseCountValue},
+	"num_threads":        {"plugin_num_threads", parseCountValue},
+}
+
+// help returns the help text of the gauge of the setting key.
+func (g configGauge) help(key string) string {
+	if isByteMetric(g.name) {
+		return "The plugin's " + key + " setting in bytes, when configured."
+	}
+	return "The plugin's " + key + " setting, when configured."
+}
+
+func parseSizeValue(s string) (float64, error) {
+	size, err := parseFluentdSize(s)
+	return float64(size), err
+}
+
+func parseDurationValue(s string) (float64, error) {
+	d, err := parseFluentdDuration(s)
+	return d.Seconds(), err
+}
+
+func parseCountValue(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid count %q", s)
+	}
+	return n, nil
+}
+
+// configString returns the plugin's config value for key, or "" when unset.
+func (p Plugin) configString(key string) string {
+	v, ok := p.Config[key]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// setConfigMetrics sets the metrics derived from the plugin's config, when
+// ExporterOpts.ExposeConfig is on.
+func (e *Exporter) setConfigMetrics(plugin Plugin, labels prometheus.Labels) {
+	if !e.exposeConfig {
+		return
+	}
+
+	var values []string
+	for _, key := range retryConfigKeys {
+		values = append(values, key, plugin.configString(key))
+	}
+	e.retryConfigInfo.With(withLabels(labels, values...)).Set(1)
+
+	if plugin.Buffered() {
+		compressed := 0.0
+		if c := plugin.bufferConfigString("compress"); c != "" && c != "text" {
+			compressed = 1
+		}
+		e.bufferCompressed.With(labels).Set(compressed)
+
+		for key, g := range configGauges {
+			value := plugin.bufferConfigString(key)
+			if value == "" {
+				continue
+			}
+			v, err := g.parse(value)
+			if err != nil {
+				log.Debugf("Failed to parse %s of %s. %s", key, plugin.PluginId, err)
+				continue
+			}
+			if key == "total_limit_size" && v > 0 && plugin.BufTotalQueuedSize != nil {
+				e.bufferFullness.With(labels).Set(*plugin.BufTotalQueuedSize / v)
+			}
+			if isByteMetric(g.name) {
+				v = e.scaleBytes(v)
+			}
+			e.configGauges[key].With(labels).Set(v)
+		}
+	}
+}
+
+// bufferConfigString is like configString for a buffer setting, which v1
+// configs put in a <buffer> section and v0.12 ones at the top level.
+func (p Plugin) bufferConfigString(key string) string {
+	if buffer, ok := p.Config["buffer"].(map[string]interface{}); ok {
+		if v, ok := buffer[key]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return p.configString(key)
+}
+
+// parseFluentdSize parses a Fluentd config size value: a number of bytes with
+// an optional k, m, g or t suffix, in either case, for powers of 1024.
+func parseFluentdSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s) - 1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		case 't', 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s) - 1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	// ParseFloat accepts "inf" and "nan", and float64(math.MaxInt64) is 2^63,
+	// which int64 can't hold.
+	if err != nil || f < 0 || math.IsNaN(f) || f * float64(multiplier) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(f * float64(multiplier)), nil
+}
+
+// parseFluentdDuration parses a Fluentd config time value: a number of seconds
+// with an optional s, m, h or d (24h) suffix, e.g. "72h", "1.5d" or "30".
+func parseFluentdDuration(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	unit := time.Second
+	if s != "" {
+		switch s[len(s) - 1] {
+		case 's':
+			s = s[:len(s) - 1]
+		case 'm':
+			s, unit = s[:len(s) - 1], time.Minute
+		case 'h':
+			s, unit = s[:len(s) - 1], time.Hour
+		case 'd':
+			s, unit = s[:len(s) - 1], 24 * time.Hour
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	// ParseFloat accepts "inf" and "nan", neither of which is a Fluentd time.
+	if err != nil || f < 0 || math.IsNaN(f) || f * float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return time.Duration(f * float64(unit)), nil
+}
+
+// nearRetryTimeout reports whether the plugin has been retrying for at least
+// ExporterOpts.RetryTimeoutFraction of its retry_timeout, after which Fluentd
+// gives up and drops the chunk.
+func (e *Exporter) nearRetryTimeout(plugin Plugin) bool {
+	if plugin.Retry == nil || len(plugin.Retry.Start) == 0 {
+		return false
+	}
+	timeout := plugin.configString("retry_timeout")
+	if timeout == "" {
+		return false
+	}
+	limit, err := parseFluentdDuration(timeout)
+	if err != nil {
+		log.Debugf("Failed to parse retry_timeout of %s. %s", plugin.PluginId, err)
+		return false
+	}
+	start, err := parseAgentTime(plugin.Retry.Start)
+	if err != nil {
+		log.Debugf("Failed to parse retry.start of %s. %s", plugin.PluginId, err)
+		return false
+	}
+	return plugin.ScrapedAt.Sub(start).Seconds() >= e.retryTimeoutFraction * limit.Seconds()
+}
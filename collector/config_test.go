@@ -0,0 +1,268 @@
+package collector
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryConfigInfo(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"retry_count":0,"config":{"@type":"s3","retry_max_interval":"30s","retry_timeout":"72h","retry_wait":1}},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0,"config":{"@type":"stdout"}}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, ExposeConfig: true})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_plugin_retry_config_info{pluginId="out_s3",pluginType="s3",retry_max_interval="30s",retry_timeout="72h",retry_wait="1",worker=""}`: 1,
+		// Settings that aren't in the config are empty.
+		`fluentd_plugin_retry_config_info{pluginId="out_stdout",pluginType="stdout",retry_max_interval="",retry_timeout="",retry_wait="",worker=""}`: 1,
+	})
+}
+
+func TestRetryConfigInfoDisabled(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	if series := seriesOf(collect(t, e), "fluentd_plugin_retry_config_info"); len(series) != 0 {
+		t.Errorf("got %v without ExposeConfig", series)
+	}
+}
+
+func TestNearRetryTimeout(t *testing.T) {
+	now := time.Now()
+	retrying := func(id string, since time.Duration, config map[string]interface{}) Plugin {
+		start := json.RawMessage(strconv.FormatInt(now.Add(-since).Unix(), 10))
+		return Plugin{PluginId: id, PluginType: "s3", OutputPlugin: true, RetryCount: 1, Retry: &PluginRetry{Start: start}, Config: config, ScrapedAt: now}
+	}
+	hour := map[string]interface{}{"retry_timeout": "1h"}
+	plugins := []Plugin{
+		retrying("out_near", 55 * time.Minute, hour),
+		retrying("out_far", 10 * time.Minute, hour),
+		retrying("out_default", 55 * time.Minute, nil),
+		{PluginId: "out_ok", PluginType: "s3", OutputPlugin: true, Config: hour, ScrapedAt: now},
+	}
+
+	for _, tt := range []struct {
+		fraction float64
+		want     float64
+	}{
+		{0, 1}, // 0.8 by default
+		{0.1, 2},
+		{0.99, 0},
+	} {
+		e := newTestExporter(t, ExporterOpts{ExposeConfig: true, RetryTimeoutFraction: tt.fraction})
+		applyPlugins(e, plugins...)
+		got := testutil.ToFloat64(e.nearRetryTimeoutPlugins)
+		if got != tt.want {
+			t.Errorf("fraction %g: plugins_near_retry_timeout = %g, want %g", tt.fraction, got, tt.want)
+		}
+	}
+}
+
+func TestBufferCompressed(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_gzip","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"@type":"s3","buffer":{"@type":"file","compress":"gzip"}}},
+		{"plugin_id":"out_flat","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"@type":"s3","compress":"gzip"}},
+		{"plugin_id":"out_text","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"@type":"s3","buffer":{"compress":"text"}}},
+		{"plugin_id":"out_none","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"@type":"s3"}},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0,"config":{"@type":"stdout"}}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, ExposeConfig: true})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_plugin_buffer_compressed{pluginId="out_gzip",pluginType="s3",worker=""}`: 1,
+		`fluentd_plugin_buffer_compressed{pluginId="out_flat",pluginType="s3",worker=""}`: 1,
+		`fluentd_plugin_buffer_compressed{pluginId="out_text",pluginType="s3",worker=""}`: 0,
+		`fluentd_plugin_buffer_compressed{pluginId="out_none",pluginType="s3",worker=""}`: 0,
+	})
+	// Only buffered plugins have a buffer to compress.
+	if series := seriesOf(got, "fluentd_plugin_buffer_compressed"); len(series) != 4 {
+		t.Errorf("got %v, want the buffered plugins only", series)
+	}
+}
+
+func TestBufferFullness(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_mib","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":134217728,"retry_count":0,"config":{"buffer":{"total_limit_size":"512m"}}},
+		{"plugin_id":"out_gib","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":1073741824,"retry_count":0,"config":{"total_limit_size":"8G"}},
+		{"plugin_id":"out_bytes","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0,"config":{"buffer":{"total_limit_size":"1000"}}},
+		{"plugin_id":"out_unknown","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0,"config":{"buffer":{}}},
+		{"plugin_id":"out_invalid","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0,"config":{"buffer":{"total_limit_size":"lots"}}}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, ExposeConfig: true})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_fullness_ratio{pluginId="out_mib",pluginType="s3",worker=""}`:   0.25,
+		`fluentd_buffer_fullness_ratio{pluginId="out_gib",pluginType="s3",worker=""}`:   0.125,
+		`fluentd_buffer_fullness_ratio{pluginId="out_bytes",pluginType="s3",worker=""}`: 0.1,
+	})
+	if series := seriesOf(got, "fluentd_buffer_fullness_ratio"); len(series) != 3 {
+		t.Errorf("got %v, want none without a valid total_limit_size", series)
+	}
+}
+
+func TestParseFluentdSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		err   bool
+	}{
+		{value: "0", want: 0},
+		{value: "1024", want: 1024},
+		{value: " 512 ", want: 512},
+		{value: "8k", want: 8 << 10},
+		{value: "8K", want: 8 << 10},
+		{value: "256m", want: 256 << 20},
+		{value: "1.5m", want: 3 << 19},
+		{value: "8g", want: 8 << 30},
+		{value: "2T", want: 2 << 40},
+		{value: "", err: true},
+		{value: "m", err: true},
+		{value: "-1", err: true},
+		{value: "-1k", err: true},
+		{value: "8x", err: true},
+		{value: "8mb", err: true},
+		{value: "inf", err: true},
+		{value: "+Inf", err: true},
+		{value: "NaN", err: true},
+		{value: "nanm", err: true},
+		{value: "1e30t", err: true},
+		{value: "8388608t", err: true}, // 2^63
+	}
+	for _, tt := range tests {
+		got, err := parseFluentdSize(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseFluentdSize(%q) = %d, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseFluentdSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseFluentdDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{value: "0", want: 0},
+		{value: "30", want: 30 * time.Second},
+		{value: " 5 ", want: 5 * time.Second},
+		{value: "0.5", want: 500 * time.Millisecond},
+		{value: "10s", want: 10 * time.Second},
+		{value: "5m", want: 5 * time.Minute},
+		{value: "1.5m", want: 90 * time.Second},
+		{value: "72h", want: 72 * time.Hour},
+		{value: "1d", want: 24 * time.Hour},
+		{value: "7d", want: 7 * 24 * time.Hour},
+		{value: "", err: true},
+		{value: "s", err: true},
+		{value: "-1", err: true},
+		{value: "-1m", err: true},
+		{value: "10w", err: true},
+		{value: "10ms", err: true},
+		{value: "1h30m", err: true},
+		{value: "inf", err: true},
+		{value: "+Infs", err: true},
+		{value: "NaN", err: true},
+		{value: "nand", err: true},
+		{value: "1e30d", err: true},
+		{value: "9223372036.854775808", err: true}, // 2^63 ns
+	}
+	for _, tt := range tests {
+		got, err := parseFluentdDuration(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseFluentdDuration(%q) = %s, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseFluentdDuration(%q) = %s, %v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCountValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		err   bool
+	}{
+		{value: "0", want: 0},
+		{value: "64", want: 64},
+		{value: " 8 ", want: 8},
+		{value: "", err: true},
+		{value: "-1", err: true},
+		{value: "inf", err: true},
+		{value: "+Inf", err: true},
+		{value: "-Inf", err: true},
+		{value: "NaN", err: true},
+		{value: "eight", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCountValue(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseCountValue(%q) = %g, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCountValue(%q) = %g, %v, want %g", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestBufferLimits(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"buffer":{"chunk_limit_size":"8m","total_limit_size":"512m","queue_limit_length":"64"}}}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, ExposeConfig: true})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_plugin_buffer_chunk_limit_bytes{pluginId="out_s3",pluginType="s3",worker=""}`:  8 << 20,
+		`fluentd_plugin_buffer_total_limit_bytes{pluginId="out_s3",pluginType="s3",worker=""}`:  512 << 20,
+		`fluentd_plugin_buffer_queue_limit_length{pluginId="out_s3",pluginType="s3",worker=""}`: 64,
+	})
+}
+
+func TestFlushConfigGauges(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"buffer":{"flush_interval":"1m","flush_thread_count":"4"}}},
+		{"plugin_id":"out_old","type":"forward","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"flush_interval":"10","num_threads":2}},
+		{"plugin_id":"out_invalid","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"config":{"buffer":{"flush_interval":"soon","flush_thread_count":"-1"}}}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, ExposeConfig: true})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_plugin_flush_interval_seconds{pluginId="out_s3",pluginType="s3",worker=""}`:       60,
+		`fluentd_plugin_flush_thread_count{pluginId="out_s3",pluginType="s3",worker=""}`:           4,
+		`fluentd_plugin_flush_interval_seconds{pluginId="out_old",pluginType="forward",worker=""}`: 10,
+		`fluentd_plugin_num_threads{pluginId="out_old",pluginType="forward",worker=""}`:            2,
+	})
+	for _, name := range []string{"fluentd_plugin_flush_interval_seconds", "fluentd_plugin_flush_thread_count"} {
+		for _, series := range seriesOf(got, name) {
+			if labelValue(series, "pluginId") == "out_invalid" {
+				t.Errorf("got %s for an invalid setting", series)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package collector_test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func ExampleNewExporter() {
+	// A stand-in for Fluentd's monitor_agent.
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_total_queued_size":2048,"retry_count":0}]}`)
+	}))
+	defer agent.Close()
+
+	exporter, err := collector.NewExporter(collector.ExporterOpts{
+		Endpoints: []string{agent.URL},
+		Namespace: "fluentd",
+		Timeout:   5 * time.Second,
+		Metrics:   []string{"buffer_queue_length"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	// The Exporter scrapes Fluentd whenever the registry is gathered.
+	reg.MustRegister(exporter)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "fluentd_buffer_queue_length" {
+			for _, m := range mf.GetMetric() {
+				fmt.Println(mf.GetName(), m.GetGauge().GetValue())
+			}
+		}
+	}
+	// Output: fluentd_buffer_queue_length 3
+}
@@ -0,0 +1,1823 @@
+// Package collector implements a Prometheus collector for the Fluentd monitor
+// agent, so it can be embedded in other exporters.
+package collector
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// pluginMetricHelp holds the plugin metrics that can be enabled with ExporterOpts.Metrics.
+var pluginMetricHelp = map[string]string{
+	"buffer_queue_length":                        "Number of chunks queued for flushing in the plugin's buffer (buffer_queue_length).",
+	"buffer_total_queued_size":                   "Size in bytes of the chunks in the plugin's buffer (buffer_total_queued_size).",
+	"retry_count":                                "Number of retries of failed flushes since the plugin started (retry_count).",
+	"buffer_pending_total":                       "Number of chunks staged or queued in the plugin's buffer (buffer_stage_length + buffer_queue_length).",
+	"buffer_queued_chunks":                       "Number of queued chunks in the plugin's buffer as reported by newer agents (buffer_queued_chunks).",
+	"plugin_emit_rate":                           "Approximate emit_count per second between the last two scrapes.",
+	"retry_next_time_seconds":                    "retry.next_time as a Unix timestamp, while the plugin is retrying.",
+	"buffer_estimated_drain_seconds":             "Rough estimate of the time to drain buffer_queue_length at the smoothed emit rate.",
+	"emit_write_gap":                             "emit_count - write_count: records emitted to the plugin but not written out yet.",
+	"plugin_seconds_since_empty":                 "Seconds since buffer_queue_length was last seen at 0, or since the exporter first saw the plugin.",
+	"buffer_queued_size_growth_bytes_per_second": "Change of buffer_total_queued_size in bytes per second between the last two scrapes; negative while draining.",
+}
+
+// bufferMetrics are the plugin metrics only buffered output plugins report.
+var bufferMetrics = map[string]bool{
+	"buffer_queue_length":      true,
+	"buffer_total_queued_size": true,
+}
+
+// pluginState is what the exporter remembers about a plugin between scrapes.
+type pluginState struct {
+	pluginId    string
+	worker      string
+	emitCount   float64
+	emitTime    time.Time
+	emitRateEMA float64 // exponential moving average of the emit rate
+	hasRate     bool    // whether emitRateEMA has been set
+	queuedSize  float64
+	queuedTime  time.Time
+	pluginType  string
+	staging     bool      // whether it had staged chunks but an empty queue
+	lastEmpty   time.Time // when buffer_queue_length was last 0, or first seen
+}
+
+// emitRateAlpha is the weight of the newest rate in pluginState.emitRateEMA.
+const emitRateAlpha = 0.3
+
+// minEmitRate is the smoothed emit rate below which a plugin counts as not
+// emitting. The EMA only approaches 0 once emits stop.
+const minEmitRate = 1e-3
+
+// ExporterOpts configures an Exporter.
+type ExporterOpts struct {
+	Endpoints             []string      // monitor agent endpoints scraped as one target
+	WorkerLabels          []string      // worker label of each endpoint; the endpoint's host when empty
+	Fallback              string        // endpoint tried when the single endpoint fails, optional
+	Namespace             string        // namespace for metrics, may be empty
+	Timeout               time.Duration // timeout for trying to get stats from Fluentd, 5s when 0
+	DialAddress           string        // host:port dialed instead of the endpoint's host, optional
+	TLSServerName         string        // name verified in the agent's certificate instead of the endpoint's host, optional
+	TLSCAFile             string        // PEM file of the CAs the agent's certificate is verified against, optional
+	TLSCertFile           string        // PEM client certificate presented to the agent, optional
+	TLSKeyFile            string        // PEM key of TLSCertFile
+	CacheTTL              time.Duration // how long a scrape result is reused, no caching when 0
+	StrictDecode          bool          // reject unknown fields in the agent response
+	MaxResponseBytes      int64         // maximum response size, unlimited when 0
+	Metrics               []string      // plugin metrics to expose, see pluginMetricHelp; defaultMetrics when nil
+	PluginTypeAllow       []string      // plugin types to scrape, all when empty
+	PluginTypeDeny        []string      // plugin types not to scrape, wins over PluginTypeAllow
+	IDLabelTemplate       string        // regexp whose named groups are extracted from pluginId as labels, optional
+	SnakeCaseLabels       bool          // name the labels plugin_type and plugin_id
+	ExposeConfig          bool          // expose metrics derived from each plugin's config
+	AgentConfig           bool          // also scrape /api/config.json for fluentd_config_info
+	FollowRedirects       bool          // follow 3xx responses instead of failing the scrape
+	ZeroMissing           bool          // expose 0 with buffered="false" for non-buffered plugins instead of skipping them
+	AllPlugins            bool          // also scrape input and filter plugins for plugin_is_output only
+	AllowJSONP            bool          // strip a JSONP callback wrapping the response instead of failing
+	TypeInName            bool          // put the plugin type into plugin metric names instead of a label
+	NamespaceFromIDPrefix bool          // add a logical_namespace label from the plugin id up to the first underscore
+	TagFilter             string        // tag the agent is asked to report the matching plugins of, optional
+	TopK                  int           // expose only this many plugins by queued size, merging the rest into "other"; all when 0
+	LockTimeout           time.Duration // how long a Collect waits for a scrape in flight before serving stale metrics, no limit when 0
+	HoldLastGood          bool          // keep the metrics of the last successful scrape when a scrape fails, setting only up to 0
+	ByteUnit              string        // unit byte-valued metrics are scaled to and named after: bytes (when empty), kib or mib
+
+	// RetryTimeoutFraction is the share of retry_timeout a plugin has to have
+	// been retrying for to count in plugins_near_retry_timeout. Only used with
+	// ExposeConfig; 0 means 0.8.
+	RetryTimeoutFraction float64
+
+	// FetchRetries is the number of times a failed fetch from an endpoint is
+	// retried within a scrape, not at all when 0. Fetches refused by an open
+	// breaker are not retried.
+	FetchRetries int
+
+	// FailureThreshold is the number of consecutive failed fetches after which
+	// an endpoint is not fetched for FailureCooldown, 1m when 0. Disabled when
+	// FailureThreshold is 0.
+	FailureThreshold int
+	FailureCooldown  time.Duration
+}
+
+// Exporter collects metrics of the plugins of one logical Fluentd target
+// from its monitor agent(s).
+type Exporter struct {
+	endpoints             []string
+	workerLabels          map[string]string // keyed by endpoint
+	fallback              string
+	namespace             string
+	client                *http.Client
+	pluginTypeAllow       map[string]bool
+	pluginTypeDeny        map[string]bool
+	idLabelTemplate       *regexp.Regexp
+	typeLabel             string
+	idLabel               string
+	cacheTTL              time.Duration
+	strictDecode          bool
+	maxResponseBytes      int64
+	exposeConfig          bool
+	agentConfig           bool
+	zeroMissing           bool
+	allPlugins            bool
+	allowJSONP            bool
+	typeInName            bool
+	namespaceFromIDPrefix bool
+	tagFilter             string
+	topK                  int
+	lockTimeout           time.Duration
+	holdLastGood          bool
+	retryTimeoutFraction  float64
+	byteUnit              byteUnit
+	byteUnitName          string
+	lastScrape            time.Time
+	lastErr               error
+	inFlight              *scrapeCall // nil when no scrape is running
+	fetchRetries          int
+	failureThreshold      int
+	failureCooldown       time.Duration
+	breakers              map[string]*breaker // keyed by endpoint
+	tlsFiles              *tlsFiles
+
+	duration                prometheus.Gauge
+	totalScrapes            prometheus.Counter
+	error                   prometheus.Gauge
+	up                      prometheus.Gauge
+	totalErrors             prometheus.Counter
+	totalSuccesses          prometheus.Counter
+	timeouts                prometheus.Counter
+	retries                 prometheus.Counter
+	errorRatio              prometheus.Gauge
+	outcomes                outcomeRing
+	errorCauses             *prometheus.CounterVec
+	errorInfo               *prometheus.GaugeVec
+	errorMessages           map[string]bool // distinct messages errorInfo has used
+	activeScrapes           prometheus.Gauge
+	lockWait                prometheus.Histogram
+	lockTimeouts            prometheus.Counter
+	usingFallback           prometheus.Gauge
+	totalQueuedSize         prometheus.Gauge
+	totalRetryCount         prometheus.Gauge
+	anonymousPlugins        prometheus.Gauge
+	pluginTypes             prometheus.Gauge
+	avgQueueLengthByType    *prometheus.GaugeVec
+	largestPlugin           *prometheus.GaugeVec
+	timekeySpread           *prometheus.GaugeVec
+	pluginCategories        *prometheus.GaugeVec
+	idlePlugins             prometheus.Gauge
+	stagingPlugins          prometheus.Gauge
+	neverFlushedPlugins     prometheus.Gauge
+	exportedSeries          prometheus.Gauge
+	nearRetryTimeoutPlugins prometheus.Gauge
+	cacheHits               prometheus.Counter
+	cacheMisses             prometheus.Counter
+	coalescedScrapes        prometheus.Counter
+	retryTimeErrors         prometheus.Counter
+	retryConfigInfo         *prometheus.GaugeVec
+	bufferCompressed        *prometheus.GaugeVec
+	bufferFullness          *prometheus.GaugeVec
+	configGauges            map[string]*prometheus.GaugeVec // keyed by config key, see configGauges
+	outputMode              *prometheus.GaugeVec
+	typeChanges             *prometheus.CounterVec
+	secondary               *prometheus.GaugeVec
+	isOutput                *prometheus.GaugeVec
+	configInfo              *prometheus.GaugeVec
+	workerStart             *prometheus.GaugeVec
+	workerDuration          *prometheus.GaugeVec
+	circuitOpen             *prometheus.GaugeVec
+	responseAge             *prometheus.GaugeVec
+	dataAge                 *prometheus.GaugeVec
+	decodeDuration          *prometheus.GaugeVec
+	workerPid               *prometheus.GaugeVec
+
+	pluginMetrics    map[string]*prometheus.GaugeVec // keyed by metric name, enabled ones only
+	pluginLabelNames map[string][]string             // label names of every enabled plugin metric
+	typedMetrics     map[string]*prometheus.GaugeVec // with typeInName, keyed by full metric name
+	pluginStates     map[string]*pluginState         // keyed by Plugin.key()
+	schemaLog        sync.Once
+
+	sync.RWMutex
+}
+
+// defaultTimeout is ExporterOpts.Timeout when unset.
+const defaultTimeout = 5 * time.Second
+
+// defaultMetrics are the plugin metrics exposed when ExporterOpts.Metrics is nil.
+var defaultMetrics = []string{"buffer_queue_length", "buffer_total_queued_size", "retry_count"}
+
+// NewExporter returns an Exporter configured by opts, or an error when opts are invalid.
+func NewExporter(opts ExporterOpts) (*Exporter, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = defaultMetrics
+	}
+	namespace, timeout, dialAddress := opts.Namespace, opts.Timeout, opts.DialAddress
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		// Fail with the 3xx response rather than silently sending the
+		// request, and any credentials in it, to another host.
+		return http.ErrUseLastResponse
+	}
+	if opts.FollowRedirects {
+		checkRedirect = nil
+	}
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, fmt.Errorf("a TLS client certificate needs both a cert and a key file")
+	}
+	unit, unitName, err := parseByteUnit(opts.ByteUnit)
+	if err != nil {
+		return nil, err
+	}
+	files := &tlsFiles{caFile: opts.TLSCAFile, certFile: opts.TLSCertFile, keyFile: opts.TLSKeyFile}
+	// An empty ServerName is taken from the endpoint's host.
+	tlsConfig, err := files.config(opts.TLSServerName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS config. %s", err)
+	}
+
+	e := Exporter{
+		endpoints: opts.Endpoints,
+		workerLabels: map[string]string{},
+		fallback: opts.Fallback,
+		namespace: namespace,
+		pluginTypeAllow: stringSet(opts.PluginTypeAllow),
+		pluginTypeDeny: stringSet(opts.PluginTypeDeny),
+		cacheTTL: opts.CacheTTL,
+		strictDecode: opts.StrictDecode,
+		maxResponseBytes: opts.MaxResponseBytes,
+		exposeConfig: opts.ExposeConfig,
+		agentConfig: opts.AgentConfig,
+		zeroMissing: opts.ZeroMissing,
+		allPlugins: opts.AllPlugins,
+		allowJSONP: opts.AllowJSONP,
+		typeInName: opts.TypeInName,
+		namespaceFromIDPrefix: opts.NamespaceFromIDPrefix,
+		tagFilter: opts.TagFilter,
+		topK: opts.TopK,
+		lockTimeout: opts.LockTimeout,
+		holdLastGood: opts.HoldLastGood,
+		retryTimeoutFraction: opts.RetryTimeoutFraction,
+		byteUnit: unit,
+		byteUnitName: unitName,
+		fetchRetries: opts.FetchRetries,
+		failureThreshold: opts.FailureThreshold,
+		failureCooldown: opts.FailureCooldown,
+		breakers: map[string]*breaker{},
+		tlsFiles: files,
+		client: &http.Client{
+			CheckRedirect: checkRedirect,
+			Transport: &http.Transport{
+				Dial: func(netw, addr string) (net.Conn, error) {
+					if dialAddress != "" {
+						addr = dialAddress
+					}
+					c, err := net.DialTimeout(netw, addr, timeout)
+					if err != nil {
+						return nil, err
+					}
+					if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+						return nil, err
+					}
+					return c, nil
+				},
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_scrape_duration_seconds",
+			Help:      "Duration in seconds of the last scrape of metrics from Fluentd.",
+		}),
+		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrapes_total",
+			Help:      "Total number of times Fluentd was scraped for metrics.",
+		}),
+		error: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_scrape_error",
+			Help:      "Whether the last scrape of metrics from Fluentd resulted in an error (1 for error, 0 for success).",
+		}),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "up",
+			Help:      "Whether the last scrape of metrics from Fluentd succeeded (1) or not (0).",
+		}),
+		totalErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_errors_total",
+			Help:      "Total number of scrapes of Fluentd that failed for at least one endpoint.",
+		}),
+		totalSuccesses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_success_total",
+			Help:      "Total number of scrapes of Fluentd that succeeded for every endpoint.",
+		}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_timeouts_total",
+			Help:      "Total number of fetches from Fluentd that timed out, also counted as cause=\"timeout\" in scrape_error_causes_total.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_retries_total",
+			Help:      "Total number of fetches from Fluentd retried after a failure within the same scrape.",
+		}),
+		errorRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scrape_error_ratio",
+			Help:      fmt.Sprintf("Share of the last %d scrapes of Fluentd that resulted in an error.", errorRatioWindow),
+		}),
+		errorCauses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_error_causes_total",
+			Help:      "Total number of failed fetches from Fluentd, by cause.",
+		}, []string{"cause"}),
+		errorInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_scrape_error_info",
+			Help:      "Error message of the last scrape, absent when it succeeded.",
+		}, []string{"message"}),
+		errorMessages: map[string]bool{},
+		activeScrapes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_active_scrapes",
+			Help:      "Number of Collect calls currently in progress, including those waiting for the lock.",
+		}),
+		lockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "collect_lock_wait_seconds",
+			Help:      "Time in seconds Collect waited for other collects: to acquire the exporter lock and for a scrape in flight to finish.",
+			Buckets:   []float64{.0001, .001, .01, .1, 1, 10},
+		}),
+		lockTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lock_timeouts_total",
+			Help:      "Total number of collects that gave up waiting for a scrape in flight and served the previous metrics.",
+		}),
+		usingFallback: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_endpoint_is_fallback",
+			Help:      "Whether the last scrape was served by the fallback endpoint (1 for fallback, 0 for primary).",
+		}),
+		totalRetryCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "retry_count_all",
+			Help:      "Sum of retry_count over all scraped plugins; non-zero once anything has retried.",
+		}),
+		anonymousPlugins: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "plugins_without_explicit_id",
+			Help:      "Number of scraped plugins with a generated object:... id instead of an @id, which changes on every Fluentd restart.",
+		}),
+		pluginTypes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "distinct_plugin_types",
+			Help:      "Number of distinct plugin types among the scraped plugins.",
+		}),
+		pluginCategories: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "plugins_by_category",
+			Help:      "Number of plugins the agent reports, by plugin_category.",
+		}, []string{"category"}),
+		nearRetryTimeoutPlugins: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "plugins_near_retry_timeout",
+			Help:      "Number of plugins retrying for long enough that they are close to reaching retry_timeout and dropping data.",
+		}),
+		exportedSeries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exported_series",
+			Help:      "Number of series this exporter exposed after the last scrape, including this one.",
+		}),
+		stagingPlugins: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "plugins_staging_not_flushing",
+			Help:      "Number of plugins with staged chunks but an empty queue in the last two scrapes, which points at a flush trigger problem.",
+		}),
+		neverFlushedPlugins: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "plugins_never_flushed",
+			Help:      "Number of plugins that emitted records but have a write_count of 0, i.e. never flushed a chunk since the worker started.",
+		}),
+		idlePlugins: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "idle_plugins",
+			Help:      "Number of plugins whose emit_count did not increase since the previous scrape.",
+		}),
+		configInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_info",
+			Help:      "Global settings from the monitor agent's /api/config.json.",
+		}, []string{"worker", "process_name", "workers", "version"}),
+		workerDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "worker_fetch_duration_seconds",
+			Help:      "Duration in seconds of the last fetch of /api/plugins.json from each worker endpoint.",
+		}, []string{"worker"}),
+		circuitOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "circuit_open",
+			Help:      "Whether fetches from the worker endpoint are suspended after consecutive failures (1) or not (0).",
+		}, []string{"worker"}),
+		responseAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "response_age_seconds",
+			Help:      "Age header of the last /api/plugins.json response from each worker endpoint, i.e. how long a cache in front of the agent held it. 0 without one.",
+		}, []string{"worker"}),
+		dataAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "agent_data_age_seconds",
+			Help:      "Time between the timestamp of the last /api/plugins.json response from each worker endpoint and its receipt, for agents reporting one.",
+		}, []string{"worker"}),
+		decodeDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "json_decode_duration_seconds",
+			Help:      "Time spent reading and decoding the body of the last /api/plugins.json response from each worker endpoint.",
+		}, []string{"worker"}),
+		workerStart: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "worker_start_timestamp_seconds",
+			Help:      "Start time of the worker from /api/config.json as a Unix timestamp, for agents reporting start_time.",
+		}, []string{"worker"}),
+		workerPid: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "worker_pid",
+			Help:      "Process id of the worker from /api/config.json. A change means the worker restarted.",
+		}, []string{"worker"}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_cache_hits_total",
+			Help:      "Total number of collects served from the cached scrape result.",
+		}),
+		retryTimeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "retry_time_parse_errors_total",
+			Help:      "Total number of retry.next_time values that could not be parsed.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_cache_misses_total",
+			Help:      "Total number of collects that fetched from Fluentd.",
+		}),
+		coalescedScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "coalesced_scrapes_total",
+			Help:      "Total number of collects that waited for a scrape already in flight instead of fetching.",
+		}),
+		pluginMetrics: map[string]*prometheus.GaugeVec{},
+		pluginLabelNames: map[string][]string{},
+		typedMetrics: map[string]*prometheus.GaugeVec{},
+		pluginStates: map[string]*pluginState{},
+	}
+
+	seen := map[string]bool{}
+	for _, endpoint := range opts.Endpoints {
+		if seen[endpoint] {
+			return nil, fmt.Errorf("duplicate endpoint %q", endpoint)
+		}
+		seen[endpoint] = true
+	}
+	if len(opts.WorkerLabels) > 0 {
+		if len(opts.WorkerLabels) != len(opts.Endpoints) {
+			return nil, fmt.Errorf("got %d worker labels for %d endpoints", len(opts.WorkerLabels), len(opts.Endpoints))
+		}
+		for i, endpoint := range opts.Endpoints {
+			e.workerLabels[endpoint] = opts.WorkerLabels[i]
+		}
+	}
+	if e.retryTimeoutFraction == 0 {
+		e.retryTimeoutFraction = 0.8
+	}
+	if e.failureCooldown == 0 {
+		e.failureCooldown = time.Minute
+	}
+
+	e.totalQueuedSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      e.byteMetricName("buffer_total_queued_size_all"),
+		Help:      e.byteMetricHelp("buffer_total_queued_size_all", "Sum of buffer_total_queued_size over all scraped plugins, in bytes."),
+	})
+
+	e.typeLabel, e.idLabel = "pluginType", "pluginId"
+	if opts.SnakeCaseLabels {
+		e.typeLabel, e.idLabel = "plugin_type", "plugin_id"
+	}
+
+	e.largestPlugin = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "slowest_plugin_info",
+		Help:      "The plugin with the largest buffer_total_queued_size in the last scrape.",
+	}, []string{e.typeLabel, e.idLabel, "worker"})
+	e.avgQueueLengthByType = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "avg_buffer_queue_length_by_type",
+		Help:      "Mean buffer_queue_length of the buffered plugins of each type in the last scrape.",
+	}, []string{e.typeLabel})
+	e.timekeySpread = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "max_buffer_timekey_spread_seconds",
+		Help:      "Largest buffer_newest_timekey - buffer_oldest_timekey in the last scrape, i.e. how far the most lagging time-sliced output is behind, and its plugin.",
+	}, []string{e.typeLabel, e.idLabel, "worker"})
+
+	labelNames := []string{e.typeLabel, e.idLabel, "worker"}
+	if opts.IDLabelTemplate != "" {
+		re, err := regexp.Compile(opts.IDLabelTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id label template. %s", err)
+		}
+		taken := stringSet(e.reservedLabelNames())
+		for _, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if taken[name] {
+				return nil, fmt.Errorf("id label template group %q is already a label", name)
+			}
+			taken[name] = true
+			labelNames = append(labelNames, name)
+		}
+		e.idLabelTemplate = re
+	}
+	if e.namespaceFromIDPrefix {
+		labelNames = append(labelNames, "logical_namespace")
+	}
+
+	for _, name := range opts.Metrics {
+		help, ok := pluginMetricHelp[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %q", name)
+		}
+		names := labelNames
+		if opts.ZeroMissing && bufferMetrics[name] {
+			names = append(append([]string{}, labelNames...), "buffered")
+		}
+		e.pluginLabelNames[name] = names
+		e.pluginMetrics[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      e.byteMetricName(name),
+			Help:      e.byteMetricHelp(name, help),
+		}, names)
+	}
+
+	e.retryConfigInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "plugin_retry_config_info",
+		Help:      "Retry settings from the plugin's config, empty when not set.",
+	}, append(append([]string{}, labelNames...), retryConfigKeys...))
+
+	e.bufferCompressed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "plugin_buffer_compressed",
+		Help:      "Whether the plugin's buffer chunks are compressed (1) or not (0), which changes what its byte sizes count.",
+	}, labelNames)
+
+	e.bufferFullness = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_fullness_ratio",
+		Help:      "Share of the plugin's buffer total_limit_size in use, buffer_total_queued_size / total_limit_size, when configured.",
+	}, labelNames)
+
+	e.configGauges = map[string]*prometheus.GaugeVec{}
+	for key, g := range configGauges {
+		e.configGauges[key] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      e.byteMetricName(g.name),
+			Help:      e.byteMetricHelp(g.name, g.help(key)),
+		}, labelNames)
+	}
+
+	e.secondary = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "output_plugin_secondary",
+		Help:      "Whether the plugin is a <secondary> backup output, by its \":secondary\" id suffix (1) or not (0).",
+	}, labelNames)
+
+	e.isOutput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "plugin_is_output",
+		Help:      "Whether the plugin is an output plugin (1) or an input or filter plugin (0), by output_plugin.",
+	}, labelNames)
+
+	e.typeChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "plugin_type_changes_total",
+		Help:      "Total number of scrapes that found a plugin id with a different type than the previous scrape, i.e. a config edit.",
+	}, []string{e.idLabel, "worker"})
+
+	e.outputMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "output_plugin_mode",
+		Help:      "Output mode of the plugin inferred from the fields it reports: buffered or non_buffered.",
+	}, append(append([]string{}, labelNames...), "mode"))
+
+	return &e, nil
+}
+
+// LabelNames returns the names of the labels the Exporter's metrics carry.
+// Const labels added to its metrics, e.g. by a wrapping registerer, must not
+// use them.
+func (e *Exporter) LabelNames() []string {
+	names := e.reservedLabelNames()
+	if e.idLabelTemplate != nil {
+		for _, name := range e.idLabelTemplate.SubexpNames() {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// reservedLabelNames returns the names of the labels of the Exporter's
+// metrics besides the groups of the id label template, which must not reuse
+// them.
+func (e *Exporter) reservedLabelNames() []string {
+	names := []string{e.typeLabel, e.idLabel, "worker", "cause", "message", "category", "process_name", "workers", "version", "mode", "buffered"}
+	names = append(names, retryConfigKeys...)
+	// The bucket label of collect_lock_wait_seconds.
+	names = append(names, "le")
+	if e.namespaceFromIDPrefix {
+		names = append(names, "logical_namespace")
+	}
+	return names
+}
+
+// Describe implements prometheus.Collector. With ExporterOpts.TypeInName the
+// metric names depend on the plugin types found, so it describes nothing and
+// the Exporter is an unchecked collector.
+func (e *Exporter) Describe(ch chan <- *prometheus.Desc) {
+	if e.typeInName {
+		return
+	}
+
+	ch <- e.duration.Desc()
+	ch <- e.totalScrapes.Desc()
+	ch <- e.error.Desc()
+	ch <- e.up.Desc()
+	ch <- e.errorRatio.Desc()
+	ch <- e.totalErrors.Desc()
+	ch <- e.totalSuccesses.Desc()
+	ch <- e.timeouts.Desc()
+	ch <- e.retries.Desc()
+	e.errorCauses.Describe(ch)
+	e.errorInfo.Describe(ch)
+	ch <- e.activeScrapes.Desc()
+	ch <- e.lockWait.Desc()
+	ch <- e.lockTimeouts.Desc()
+	ch <- e.usingFallback.Desc()
+	ch <- e.totalQueuedSize.Desc()
+	ch <- e.totalRetryCount.Desc()
+	ch <- e.anonymousPlugins.Desc()
+	ch <- e.pluginTypes.Desc()
+	e.avgQueueLengthByType.Describe(ch)
+	e.largestPlugin.Describe(ch)
+	e.timekeySpread.Describe(ch)
+	e.pluginCategories.Describe(ch)
+	ch <- e.idlePlugins.Desc()
+	ch <- e.stagingPlugins.Desc()
+	ch <- e.neverFlushedPlugins.Desc()
+	if e.exposeConfig {
+		ch <- e.nearRetryTimeoutPlugins.Desc()
+	}
+	ch <- e.cacheHits.Desc()
+	ch <- e.cacheMisses.Desc()
+	ch <- e.coalescedScrapes.Desc()
+	ch <- e.retryTimeErrors.Desc()
+	e.retryConfigInfo.Describe(ch)
+	e.bufferCompressed.Describe(ch)
+	e.bufferFullness.Describe(ch)
+	for _, m := range e.configGauges {
+		m.Describe(ch)
+	}
+	e.outputMode.Describe(ch)
+	e.secondary.Describe(ch)
+	if e.allPlugins {
+		e.isOutput.Describe(ch)
+	}
+	e.typeChanges.Describe(ch)
+	e.configInfo.Describe(ch)
+	e.workerStart.Describe(ch)
+	e.workerDuration.Describe(ch)
+	e.circuitOpen.Describe(ch)
+	e.responseAge.Describe(ch)
+	e.dataAge.Describe(ch)
+	e.decodeDuration.Describe(ch)
+	e.workerPid.Describe(ch)
+	ch <- e.exportedSeries.Desc()
+
+	for _, m := range e.pluginMetrics {
+		m.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector. It scrapes Fluentd unless the
+// cached result is still fresh.
+func (e *Exporter) Collect(ch chan <- prometheus.Metric) {
+	e.collect(context.Background(), ch)
+}
+
+// WithContext returns the Exporter as a prometheus.Collector whose Collect
+// gives up waiting for the scrape once ctx is done, e.g. when the client of
+// the HTTP request being served disconnected. The scrape itself is canceled
+// once every Collect waiting for it gave up.
+func (e *Exporter) WithContext(ctx context.Context) prometheus.Collector {
+	return contextCollector{e, ctx}
+}
+
+type contextCollector struct {
+	*Exporter
+	ctx context.Context
+}
+
+func (c contextCollector) Collect(ch chan <- prometheus.Metric) {
+	c.collect(c.ctx, ch)
+}
+
+func (e *Exporter) collect(ctx context.Context, ch chan <- prometheus.Metric) {
+	e.activeScrapes.Inc()
+	defer e.activeScrapes.Dec()
+
+	err := e.update(ctx, false)
+
+	// Hold the read lock throughout, as apply resets and refills metric
+	// families under the lock.
+	e.RLock()
+	defer e.RUnlock()
+	e.collectMetrics(ch, err == ErrLockTimeout)
+	for _, m := range e.typedMetrics {
+		m.Collect(ch)
+	}
+}
+
+// collectMetrics sends every metric but the ExporterOpts.TypeInName ones, with
+// last_scrape_error 1 and up 0 when stale is set.
+func (e *Exporter) collectMetrics(ch chan <- prometheus.Metric, stale bool) {
+	ch <- e.duration
+	ch <- e.totalScrapes
+	if stale {
+		ch <- prometheus.MustNewConstMetric(e.error.Desc(), prometheus.GaugeValue, 1)
+		ch <- prometheus.MustNewConstMetric(e.up.Desc(), prometheus.GaugeValue, 0)
+	} else {
+		ch <- e.error
+		ch <- e.up
+	}
+	ch <- e.errorRatio
+	ch <- e.totalErrors
+	ch <- e.totalSuccesses
+	ch <- e.timeouts
+	ch <- e.retries
+	e.errorCauses.Collect(ch)
+	e.errorInfo.Collect(ch)
+	ch <- e.activeScrapes
+	ch <- e.lockWait
+	ch <- e.lockTimeouts
+	ch <- e.usingFallback
+	ch <- e.totalQueuedSize
+	ch <- e.totalRetryCount
+	ch <- e.anonymousPlugins
+	ch <- e.pluginTypes
+	e.avgQueueLengthByType.Collect(ch)
+	e.largestPlugin.Collect(ch)
+	e.timekeySpread.Collect(ch)
+	e.pluginCategories.Collect(ch)
+	ch <- e.idlePlugins
+	ch <- e.stagingPlugins
+	ch <- e.neverFlushedPlugins
+	if e.exposeConfig {
+		ch <- e.nearRetryTimeoutPlugins
+	}
+	ch <- e.cacheHits
+	ch <- e.cacheMisses
+	ch <- e.coalescedScrapes
+	ch <- e.retryTimeErrors
+	e.retryConfigInfo.Collect(ch)
+	e.bufferCompressed.Collect(ch)
+	e.bufferFullness.Collect(ch)
+	for _, m := range e.configGauges {
+		m.Collect(ch)
+	}
+	e.outputMode.Collect(ch)
+	e.secondary.Collect(ch)
+	if e.allPlugins {
+		e.isOutput.Collect(ch)
+	}
+	e.typeChanges.Collect(ch)
+	e.configInfo.Collect(ch)
+	e.workerStart.Collect(ch)
+	e.workerDuration.Collect(ch)
+	e.circuitOpen.Collect(ch)
+	e.responseAge.Collect(ch)
+	e.dataAge.Collect(ch)
+	e.decodeDuration.Collect(ch)
+	e.workerPid.Collect(ch)
+	ch <- e.exportedSeries
+
+	for _, m := range e.pluginMetrics {
+		m.Collect(ch)
+	}
+}
+
+// countSeries returns the number of series a Collect sends. It must be called
+// with the lock held.
+func (e *Exporter) countSeries() int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		e.collectMetrics(ch, false)
+		for _, m := range e.typedMetrics {
+			m.Collect(ch)
+		}
+		close(ch)
+	}()
+
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+// Scrape fetches from Fluentd outside of a Collect, e.g. to have metrics before
+// the first request. It returns the last error the scrape ran into.
+func (e *Exporter) Scrape() error {
+	return e.update(context.Background(), false)
+}
+
+// Refresh is Scrape ignoring ExporterOpts.CacheTTL, to force a fetch.
+func (e *Exporter) Refresh() error {
+	return e.update(context.Background(), true)
+}
+
+// update refreshes the metrics from Fluentd unless the cached result is still
+// fresh and force is unset, and returns the last error of the scrape the metrics come from.
+//
+// The fetch itself runs without the lock, into a snapshot that is applied to
+// the shared state afterwards, so concurrent Collects only wait for each other
+// while metrics are being set, not for the whole round trip to Fluentd.
+//
+// When ctx is done update returns its error without waiting any longer, see
+// Exporter.leave.
+//
+// collect_lock_wait_seconds observes the time update spends on other callers:
+// waiting for the lock and for a scrape in flight, but not its own scrape.
+func (e *Exporter) update(ctx context.Context, force bool) error {
+	waitStart := time.Now()
+	observeWait := func() {
+		e.lockWait.Observe(time.Since(waitStart).Seconds())
+	}
+	e.Lock()
+	for {
+		if !force && e.cacheTTL > 0 && time.Since(e.lastScrape) < e.cacheTTL {
+			observeWait()
+			e.cacheHits.Inc()
+			err := e.lastErr
+			e.Unlock()
+			return err
+		}
+		call := e.inFlight
+		if call == nil || call.waiters > 0 {
+			break
+		}
+		// Canceled after everybody waiting for it gave up, so its result is
+		// of no use. Scrapes never run concurrently, so let it wind down and
+		// start over.
+		e.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			observeWait()
+			return ctx.Err()
+		}
+		e.Lock()
+	}
+	// Wait for a scrape already in flight rather than hitting Fluentd again.
+	if call := e.inFlight; call != nil {
+		e.coalescedScrapes.Inc()
+		call.waiters++
+		e.Unlock()
+		err := e.wait(ctx, call)
+		observeWait()
+		return err
+	}
+	observeWait()
+	e.cacheMisses.Inc()
+	scrapeCtx, cancel := context.WithCancel(context.Background())
+	call := &scrapeCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	e.inFlight = call
+	e.Unlock()
+
+	go e.run(scrapeCtx, call)
+	return e.wait(ctx, call)
+}
+
+// run scrapes and applies the result for call. A scrape canceled because
+// nobody waits for it any more is not applied: it tells nothing about Fluentd.
+func (e *Exporter) run(ctx context.Context, call *scrapeCall) {
+	defer call.cancel()
+	start := time.Now()
+	snap := e.scrape(ctx)
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.inFlight = nil
+	if err := ctx.Err(); err != nil {
+		call.err = err
+		close(call.done)
+		return
+	}
+	e.apply(snap)
+	e.lastScrape = start
+	call.err = e.lastErr
+	close(call.done)
+}
+
+// ErrLockTimeout is returned when ExporterOpts.LockTimeout ran out before the
+// scrape in flight finished. That Collect sends the metrics of the previous
+// scrape with last_scrape_error 1, while other callers still see the error of
+// the last finished scrape.
+var ErrLockTimeout = fmt.Errorf("gave up waiting for the scrape in flight")
+
+// wait waits for call to finish, at most ExporterOpts.LockTimeout. When that
+// runs out, ErrLockTimeout is returned and the scrape goes on for whoever
+// calls next. When ctx is done first, its error is returned and the caller
+// leaves call.
+func (e *Exporter) wait(ctx context.Context, call *scrapeCall) error {
+	var timeout <-chan time.Time
+	if e.lockTimeout > 0 {
+		timeout = time.After(e.lockTimeout)
+	}
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-timeout:
+		e.lockTimeouts.Inc()
+		return ErrLockTimeout
+	case <-ctx.Done():
+		e.leave(call)
+		return ctx.Err()
+	}
+}
+
+// leave removes a waiter from call, canceling the scrape when it was the last
+// one. Callers timing out with ErrLockTimeout stay, as their scrape is still
+// meant to go on.
+func (e *Exporter) leave(call *scrapeCall) {
+	e.Lock()
+	defer e.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+	}
+}
+
+// scrapeCall is a scrape in flight, which concurrent collects wait for.
+type scrapeCall struct {
+	done    chan struct{} // closed once the scrape is applied
+	err     error
+	waiters int                // callers that did not give up on it, guarded by the Exporter's lock
+	cancel  context.CancelFunc // cancels the scrape
+}
+
+// snapshot is the result of one scrape.
+type snapshot struct {
+	plugins      []Plugin            // scraped output plugins
+	nonOutputs   []Plugin            // scraped input and filter plugins, with ExporterOpts.AllPlugins
+	categories   map[string]int      // number of plugins of every plugin_category
+	configs      []AgentConfig       // results of /api/config.json, when scraped
+	fallback     bool                // whether the fallback endpoint was used successfully
+	neverFlushed int                 // plugins with emit_count > 0 but write_count == 0
+	queueLengths map[string]*average // buffer_queue_length of the buffered plugins, by type
+	err          error               // last error of the scrape, nil when it succeeded
+	duration     time.Duration
+}
+
+// apply sets the metrics from snap. It must be called with the lock held.
+func (e *Exporter) apply(snap *snapshot) {
+	e.applyStatus(snap)
+	if snap.err != nil && e.holdLastGood {
+		// Keep the metrics of the last successful scrape rather than those of
+		// the workers that happened to answer, so a blip leaves no gap.
+		e.exportedSeries.Set(float64(e.countSeries()))
+		return
+	}
+
+	// Process plugins in a stable order so ties (e.g. for slowest_plugin_info)
+	// and anything depending on order don't change between identical scrapes.
+	sort.Slice(snap.plugins, func(i, j int) bool {
+		a, b := snap.plugins[i], snap.plugins[j]
+		if a.PluginId != b.PluginId {
+			return a.PluginId < b.PluginId
+		}
+		return a.Worker < b.Worker
+	})
+
+	queuedSize, retryCount := 0.0, 0.0
+	anonymous := 0
+	types := map[string]bool{}
+	var largest, lagging *Plugin
+	maxSpread := 0.0
+	for i, plugin := range snap.plugins {
+		queuedSize += plugin.TotalQueuedSize()
+		retryCount += plugin.RetryCount
+		if !plugin.explicitID() {
+			anonymous++
+		}
+		types[plugin.PluginType] = true
+		if largest == nil || plugin.TotalQueuedSize() > largest.TotalQueuedSize() {
+			largest = &snap.plugins[i]
+		}
+		if spread, ok := plugin.timekeySpread(); ok && (lagging == nil || spread > maxSpread) {
+			lagging, maxSpread = &snap.plugins[i], spread
+		}
+	}
+
+	fallback := 0
+	if snap.fallback {
+		fallback = 1
+	}
+	e.usingFallback.Set(float64(fallback))
+	e.totalQueuedSize.Set(e.scaleBytes(queuedSize))
+	e.totalRetryCount.Set(retryCount)
+	e.anonymousPlugins.Set(float64(anonymous))
+	e.neverFlushedPlugins.Set(float64(snap.neverFlushed))
+	e.pluginTypes.Set(float64(len(types)))
+	e.avgQueueLengthByType.Reset()
+	for pluginType, a := range snap.queueLengths {
+		e.avgQueueLengthByType.WithLabelValues(pluginType).Set(a.value())
+	}
+	e.pluginCategories.Reset()
+	for category, n := range snap.categories {
+		e.pluginCategories.WithLabelValues(category).Set(float64(n))
+	}
+	e.largestPlugin.Reset()
+	if largest != nil {
+		e.largestPlugin.WithLabelValues(largest.PluginType, largest.PluginId, largest.Worker).Set(1)
+	}
+	e.timekeySpread.Reset()
+	if lagging != nil {
+		e.timekeySpread.WithLabelValues(lagging.PluginType, lagging.PluginId, lagging.Worker).Set(maxSpread)
+	}
+
+	// Info metrics carry values as labels, so drop the previous ones rather
+	// than leaving a series behind for every value a setting ever had.
+	e.retryConfigInfo.Reset()
+	e.bufferCompressed.Reset()
+	e.bufferFullness.Reset()
+	for _, m := range e.configGauges {
+		m.Reset()
+	}
+	e.outputMode.Reset()
+	e.secondary.Reset()
+	e.isOutput.Reset()
+	e.configInfo.Reset()
+	e.workerStart.Reset()
+	e.workerPid.Reset()
+	for _, c := range snap.configs {
+		e.configInfo.WithLabelValues(c.Worker, c.ProcessName, c.workers(), c.Version).Set(1)
+		if c.Pid != nil {
+			e.workerPid.WithLabelValues(c.Worker).Set(*c.Pid)
+		}
+		if len(c.StartTime) > 0 {
+			if t, err := parseAgentTime(c.StartTime); err != nil {
+				log.Debugf("Failed to parse start_time of worker %q. %s", c.Worker, err)
+			} else {
+				e.workerStart.WithLabelValues(c.Worker).Set(float64(t.UnixNano()) / 1e9)
+			}
+		}
+	}
+
+	if e.topK > 0 || snap.err != nil {
+		// Plugins move in and out of the top, so drop the series of the
+		// previous selection. A failed scrape only has the plugins of the
+		// workers that answered, so drop the others' rather than keep
+		// stale values.
+		for _, m := range e.pluginMetrics {
+			m.Reset()
+		}
+		for _, m := range e.typedMetrics {
+			m.Reset()
+		}
+	}
+	plugins := e.collapse(snap.plugins)
+	e.setMetrics(plugins)
+	// Input and filter plugins only get plugin_is_output, so that they
+	// don't change the aggregates and per-plugin metrics of outputs.
+	for _, plugin := range snap.nonOutputs {
+		e.isOutput.With(e.pluginLabels(plugin)).Set(0)
+	}
+	if snap.err == nil {
+		// Plugins outside the top K are still reported: keep their state
+		// for when they get back in, along with that of "other".
+		e.forgetRemovedPlugins(append(append([]Plugin{}, snap.plugins...), plugins...))
+	}
+	e.exportedSeries.Set(float64(e.countSeries()))
+
+	if snap.err == nil && len(snap.plugins) > 0 {
+		e.schemaLog.Do(func() {
+			fields := presentFields(snap.plugins)
+			if len(fields) == 0 {
+				fields = []string{"none"}
+			}
+			log.Infof("Optional fields reported by the monitor agent: %s", strings.Join(fields, ", "))
+		})
+	}
+}
+
+// average is the running mean of a set of values.
+type average struct {
+	sum float64
+	n   int
+}
+
+func (a *average) add(v float64) {
+	a.sum += v
+	a.n++
+}
+
+// value returns the mean, 0 without values.
+func (a *average) value() float64 {
+	if a.n == 0 {
+		return 0
+	}
+	return a.sum / float64(a.n)
+}
+
+// applyStatus sets the metrics telling whether the scrape of snap succeeded.
+// It must be called with the lock held.
+func (e *Exporter) applyStatus(snap *snapshot) {
+	e.lastErr = snap.err
+	e.errorInfo.Reset()
+	if snap.err != nil {
+		e.error.Set(1)
+		e.up.Set(0)
+		e.errorInfo.WithLabelValues(e.errorMessage(snap.err)).Set(1)
+	} else {
+		e.error.Set(0)
+		e.up.Set(1)
+	}
+	e.outcomes.add(snap.err != nil)
+	e.errorRatio.Set(e.outcomes.ratio())
+	e.duration.Set(snap.duration.Seconds())
+}
+
+func (e *Exporter) fetch(ctx context.Context, endpoint string) (*PluginsBody, error) {
+	var body PluginsBody
+	u := endpoint + "/api/plugins.json"
+	if e.tagFilter != "" {
+		// Agents without tag filtering ignore the parameter and report all plugins.
+		u += "?tag=" + url.QueryEscape(e.tagFilter)
+	}
+	header, decodeDuration, err := e.fetchJSON(ctx, u, &body, e.strictDecode)
+	if err != nil {
+		return nil, err
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		body.Age = time.Duration(age) * time.Second
+	}
+	body.DecodeDuration = decodeDuration
+	return &body, nil
+}
+
+// jsonpPattern matches the start of a JSONP response, up to and including
+// the opening parenthesis.
+var jsonpPattern = regexp.MustCompile(`^\s*[A-Za-z_$][\w$.]*\s*\(`)
+
+// jsonpPrefix returns the "callback(" prefix when r starts with a JSONP
+// wrapper, without consuming anything.
+func jsonpPrefix(r *bufio.Reader) string {
+	peek, _ := r.Peek(256)
+	return string(jsonpPattern.Find(peek))
+}
+
+// jsonContentType reports whether a response of Content-Type ct may hold
+// JSON. Besides JSON types this allows text/plain, used by some proxies,
+// JavaScript for JSONP and a missing header; anything else, e.g. the HTML
+// page of a login portal, is not decoded.
+func jsonContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "text/json", "text/plain", "application/javascript", "text/javascript":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json")
+}
+
+// statusError is returned by fetchJSON for a non-2xx response.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// arrayDecoder is implemented by fetchJSON targets that also accept a bare
+// JSON array, returning what to decode the array into.
+type arrayDecoder interface {
+	arrayTarget() interface{}
+}
+
+// fetchJSON gets url and decodes the JSON response into v, rejecting unknown
+// fields when strict is set. It returns the response headers and the time
+// spent reading and decoding the body. The request is canceled with ctx.
+func (e *Exporter) fetchJSON(ctx context.Context, url string, v interface{}, strict bool) (http.Header, time.Duration, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
+		return nil, 0, &statusError{res.StatusCode, res.Status}
+	}
+	if ct := res.Header.Get("Content-Type"); !jsonContentType(ct) {
+		head := make([]byte, 128)
+		n, _ := io.ReadFull(res.Body, head)
+		log.Warnf("Response from %s has Content-Type %q, starting with %q", url, ct, head[:n])
+		return nil, 0, &scrapeError{"content_type", fmt.Errorf("response has Content-Type %q, not JSON", ct)}
+	}
+
+	// The transport only decompresses transparently when it asked for gzip
+	// itself, so handle agents or proxies that compress unasked.
+	var reader io.Reader = res.Body
+	if !res.Uncompressed && res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	// Read one byte past the limit so an oversized response can be told apart
+	// from a truncated one.
+	var limited *io.LimitedReader
+	if e.maxResponseBytes > 0 {
+		limited = &io.LimitedReader{R: reader, N: e.maxResponseBytes + 1}
+		reader = limited
+	}
+
+	buffered := bufio.NewReader(reader)
+	if callback := jsonpPrefix(buffered); callback != "" {
+		if !e.allowJSONP {
+			return nil, 0, &scrapeError{"decode", fmt.Errorf("response is wrapped in a JSONP callback %q", callback)}
+		}
+		log.Warnf("Response from %s is wrapped in a JSONP callback %q, stripping it", url, callback)
+		// json.Decoder stops after one value, so the closing ")" is never read.
+		if _, err := buffered.Discard(len(callback)); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	decodeStart := time.Now()
+	// Some Fluentd forks return the plugins as a bare array. Look at the first
+	// value byte to pick the target rather than decoding the response twice.
+	if a, ok := v.(arrayDecoder); ok && firstByte(buffered) == '[' {
+		v = a.arrayTarget()
+	}
+	decoder := json.NewDecoder(buffered)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		if limited != nil && limited.N <= 0 {
+			return nil, 0, &scrapeError{"decode", fmt.Errorf("response exceeds %d bytes", e.maxResponseBytes)}
+		}
+		if isTimeout(err) {
+			return nil, 0, &scrapeError{"timeout", fmt.Errorf("timed out reading the response. %s", err)}
+		}
+		if strict && strings.HasPrefix(err.Error(), "json: unknown field") {
+			return nil, 0, &scrapeError{"strict_decode", fmt.Errorf("response does not match the known schema. %s", err)}
+		}
+		return nil, 0, &scrapeError{"decode", fmt.Errorf("failed to decode json. %s", err)}
+	}
+	return res.Header, time.Since(decodeStart), nil
+}
+
+// firstByte returns the first byte of r that is not JSON whitespace, without
+// consuming it, or 0 when there is none.
+func firstByte(r *bufio.Reader) byte {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		r.UnreadByte()
+		return c
+	}
+}
+
+// scrape fetches from every endpoint. It only touches metrics that are safe to
+// update concurrently; the rest is left to apply. Once ctx is done it stops,
+// without counting the fetches that failed because of that as errors.
+func (e *Exporter) scrape(ctx context.Context) *snapshot {
+	// time.Since uses the monotonic clock, so unlike a UnixNano difference the
+	// duration can't go negative when the wall clock is adjusted mid-scrape.
+	start := time.Now()
+	e.totalScrapes.Inc()
+	e.reloadCA()
+	snap := &snapshot{categories: map[string]int{}, queueLengths: map[string]*average{}}
+
+	for _, endpoint := range e.endpoints {
+		if ctx.Err() != nil {
+			break
+		}
+		worker := e.worker(endpoint)
+		fetchStart := time.Now()
+		body, err := e.fetchRetrying(ctx, endpoint)
+		if err != nil && e.fallback != "" && ctx.Err() == nil {
+			log.Warnf("Failed to fetch json from %s, trying %s. %s", endpoint, e.fallback, err)
+			body, err = e.fetchRetrying(ctx, e.fallback)
+			if err == nil {
+				snap.fallback = true
+			}
+		}
+		e.workerDuration.WithLabelValues(worker).Set(time.Since(fetchStart).Seconds())
+		if e.failureThreshold > 0 {
+			open := 0
+			if e.breakerOpen(endpoint) {
+				open = 1
+			}
+			e.circuitOpen.WithLabelValues(worker).Set(float64(open))
+		}
+		if err != nil && ctx.Err() != nil {
+			log.Debugf("Gave up fetching json from %s. %s", endpoint, err)
+			snap.err = err
+			break
+		}
+		if err != nil {
+			log.Errorf("Failed to fetch json from %s. %s", endpoint, err)
+			snap.err = err
+			cause := errorCause(err)
+			e.errorCauses.WithLabelValues(cause).Inc()
+			if cause == "timeout" {
+				e.timeouts.Inc()
+			}
+			continue
+		}
+		e.responseAge.WithLabelValues(worker).Set(body.Age.Seconds())
+		e.setDataAge(worker, body.Timestamp, time.Now())
+		e.decodeDuration.WithLabelValues(worker).Set(body.DecodeDuration.Seconds())
+
+		if e.agentConfig {
+			if c, err := e.fetchConfig(ctx, endpoint); err != nil {
+				log.Warnf("Failed to fetch config json from %s. %s", endpoint, err)
+			} else if c != nil {
+				c.Worker = worker
+				snap.configs = append(snap.configs, *c)
+			}
+		}
+
+		for _, plugin := range body.Plugins {
+			if plugin.PluginCategory != "" {
+				snap.categories[plugin.PluginCategory]++
+			}
+			if !plugin.OutputPlugin && e.allPlugins && e.pluginTypeAllowed(plugin.PluginType) {
+				plugin.Worker = worker
+				snap.nonOutputs = append(snap.nonOutputs, plugin)
+			}
+			if plugin.OutputPlugin && e.pluginTypeAllowed(plugin.PluginType) {
+				plugin.Worker = worker
+				plugin.ScrapedAt = time.Now()
+				snap.plugins = append(snap.plugins, plugin)
+				if plugin.neverFlushed() {
+					snap.neverFlushed++
+				}
+				if plugin.BufQueueLength != nil {
+					a, ok := snap.queueLengths[plugin.PluginType]
+					if !ok {
+						a = &average{}
+						snap.queueLengths[plugin.PluginType] = a
+					}
+					a.add(*plugin.BufQueueLength)
+				}
+			}
+		}
+	}
+
+	if ctx.Err() == nil {
+		if snap.err != nil {
+			e.totalErrors.Inc()
+		} else {
+			e.totalSuccesses.Inc()
+		}
+	}
+	snap.duration = time.Since(start)
+	return snap
+}
+
+const (
+	maxErrorMessageLength = 200
+	maxErrorMessages      = 20
+)
+
+var (
+	// localAddrPattern matches the local address of a connection in net errors,
+	// e.g. "127.0.0.1:54321->" in "read tcp 127.0.0.1:54321->10.0.0.1:24220",
+	// whose port is different for every connection.
+	localAddrPattern = regexp.MustCompile(`\S+->`)
+	timePattern      = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+)
+
+// errorMessage turns err into a last_scrape_error_info label value. Messages
+// are stripped of control characters, local addresses and times, so the same
+// error gives the same message, and truncated. Once maxErrorMessages distinct
+// ones were used any new message is reported as "other" to keep the series
+// count bounded.
+func (e *Exporter) errorMessage(err error) string {
+	message := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, err.Error())
+	message = localAddrPattern.ReplaceAllString(message, "")
+	message = timePattern.ReplaceAllString(message, "<time>")
+	if r := []rune(message); len(r) > maxErrorMessageLength {
+		message = string(r[:maxErrorMessageLength])
+	}
+
+	if !e.errorMessages[message] {
+		if len(e.errorMessages) >= maxErrorMessages {
+			return "other"
+		}
+		e.errorMessages[message] = true
+	}
+	return message
+}
+
+// scrapeError is an error with the cause it is counted under in
+// scrape_error_causes_total. Errors of other types count as "timeout" when
+// they are timeouts and as "fetch" otherwise.
+type scrapeError struct {
+	cause string
+	err   error
+}
+
+func (e *scrapeError) Error() string {
+	return e.err.Error()
+}
+
+func errorCause(err error) string {
+	if se, ok := err.(*scrapeError); ok {
+		return se.cause
+	}
+	if isTimeout(err) {
+		return "timeout"
+	}
+	return "fetch"
+}
+
+// isTimeout reports whether err is a network timeout, e.g. of the connection
+// deadline set from ExporterOpts.Timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// pluginTypeAllowed reports whether plugins of the given type should be scraped.
+func (e *Exporter) pluginTypeAllowed(pluginType string) bool {
+	if e.pluginTypeDeny[pluginType] {
+		return false
+	}
+	return len(e.pluginTypeAllow) == 0 || e.pluginTypeAllow[pluginType]
+}
+
+// worker returns the value of the worker label for metrics scraped from endpoint:
+// its ExporterOpts.WorkerLabels entry or its host. It is empty when only one
+// endpoint is configured, so single-worker targets keep exposing the same series
+// as before.
+func (e *Exporter) worker(endpoint string) string {
+	if len(e.endpoints) < 2 {
+		return ""
+	}
+	if w, ok := e.workerLabels[endpoint]; ok {
+		return w
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+	return u.Host
+}
+
+func (e *Exporter) setMetrics(plugins []Plugin) {
+	idle, nearRetryTimeout, stuckStaging := 0, 0, 0
+	for _, plugin := range plugins {
+		labels := e.pluginLabels(plugin)
+
+		if plugin.Buffered() {
+			e.setBufferMetric("buffer_queue_length", labels, "true", plugin.QueueLength())
+			e.setBufferMetric("buffer_total_queued_size", labels, "true", e.scaleBytes(plugin.TotalQueuedSize()))
+		} else if e.zeroMissing {
+			e.setBufferMetric("buffer_queue_length", labels, "false", 0)
+			e.setBufferMetric("buffer_total_queued_size", labels, "false", 0)
+		}
+		e.setPluginMetric("retry_count", labels, plugin.RetryCount)
+
+		// buffer_stage_length is only reported by v0.14+ buffered outputs,
+		// which always report buffer_queue_length alongside it.
+		if plugin.BufStageLength != nil {
+			e.setPluginMetric("buffer_pending_total", labels, *plugin.BufStageLength + plugin.QueueLength())
+		}
+		if plugin.BufQueuedChunks != nil {
+			e.setPluginMetric("buffer_queued_chunks", labels, *plugin.BufQueuedChunks)
+		}
+
+		state, ok := e.pluginStates[plugin.key()]
+		if !ok {
+			state = &pluginState{pluginId: plugin.PluginId, worker: plugin.Worker}
+			e.pluginStates[plugin.key()] = state
+		}
+		if state.pluginType != "" && state.pluginType != plugin.PluginType {
+			e.typeChanges.WithLabelValues(plugin.PluginId, plugin.Worker).Inc()
+		}
+		state.pluginType = plugin.PluginType
+
+		// A single scrape may just fall between two flushes, so only count
+		// plugins staging without queueing in two scrapes in a row.
+		staging := plugin.BufStageLength != nil && *plugin.BufStageLength > 0 && plugin.QueueLength() == 0
+		if staging && state.staging {
+			stuckStaging++
+		}
+		state.staging = staging
+		if plugin.EmitCount != nil {
+			// A lower emit_count means the plugin restarted, which is not idle.
+			if !state.emitTime.IsZero() && *plugin.EmitCount == state.emitCount {
+				idle++
+			}
+			e.setEmitRate(state, plugin, labels)
+		}
+		if plugin.BufTotalQueuedSize != nil {
+			e.setQueuedSizeGrowth(state, plugin, labels)
+		}
+		if plugin.EmitCount != nil && plugin.WriteCount != nil {
+			e.setPluginMetric("emit_write_gap", labels, *plugin.EmitCount - *plugin.WriteCount)
+		}
+		if plugin.BufQueueLength != nil {
+			if *plugin.BufQueueLength == 0 || state.lastEmpty.IsZero() {
+				state.lastEmpty = plugin.ScrapedAt
+			}
+			e.setPluginMetric("plugin_seconds_since_empty", labels, plugin.ScrapedAt.Sub(state.lastEmpty).Seconds())
+		}
+
+		if plugin.Retry != nil && len(plugin.Retry.NextTime) > 0 {
+			if next, err := parseAgentTime(plugin.Retry.NextTime); err != nil {
+				log.Debugf("Failed to parse retry.next_time of %s. %s", plugin.PluginId, err)
+				e.retryTimeErrors.Inc()
+			} else {
+				e.setPluginMetric("retry_next_time_seconds", labels, float64(next.UnixNano()) / 1e9)
+			}
+		}
+
+		e.setConfigMetrics(plugin, labels)
+		if e.exposeConfig && e.nearRetryTimeout(plugin) {
+			nearRetryTimeout++
+		}
+
+		if e.allPlugins {
+			e.isOutput.With(labels).Set(1)
+		}
+		e.outputMode.With(withLabels(labels, "mode", plugin.outputMode())).Set(1)
+		secondary := 0.0
+		if plugin.secondary() {
+			secondary = 1
+		}
+		e.secondary.With(labels).Set(secondary)
+	}
+	e.idlePlugins.Set(float64(idle))
+	e.nearRetryTimeoutPlugins.Set(float64(nearRetryTimeout))
+	e.stagingPlugins.Set(float64(stuckStaging))
+}
+
+// forgetRemovedPlugins drops the state, plugin metric and
+// plugin_type_changes_total series of plugins no longer reported. Generated
+// object:... ids change on every Fluentd restart, so these would grow without
+// bound otherwise. Only call it after a successful scrape: a failed one doesn't
+// report the plugins of every worker.
+func (e *Exporter) forgetRemovedPlugins(plugins []Plugin) {
+	reported := make(map[string]bool, len(plugins))
+	for _, plugin := range plugins {
+		reported[plugin.key()] = true
+	}
+	for key, state := range e.pluginStates {
+		if !reported[key] {
+			delete(e.pluginStates, key)
+			e.typeChanges.DeleteLabelValues(state.pluginId, state.worker)
+			e.deletePluginSeries(Plugin{PluginId: state.pluginId, PluginType: state.pluginType, Worker: state.worker})
+		}
+	}
+}
+
+// deletePluginSeries drops the series of every plugin metric of plugin.
+func (e *Exporter) deletePluginSeries(plugin Plugin) {
+	labels := e.pluginLabels(plugin)
+	for name := range e.pluginMetrics {
+		if !stringSet(e.pluginLabelNames[name])["buffered"] {
+			e.deletePluginMetric(name, labels)
+			continue
+		}
+		for _, buffered := range []string{"true", "false"} {
+			e.deletePluginMetric(name, withLabels(labels, "buffered", buffered))
+		}
+	}
+}
+
+// setDataAge sets agent_data_age_seconds of worker from the timestamp of its
+// response, received at now, dropping the series when there is none.
+func (e *Exporter) setDataAge(worker string, timestamp json.RawMessage, now time.Time) {
+	if len(timestamp) == 0 || string(timestamp) == "null" {
+		e.dataAge.DeleteLabelValues(worker)
+		return
+	}
+	t, err := parseAgentTime(timestamp)
+	if err != nil {
+		log.Debugf("Failed to parse the timestamp of worker %q. %s", worker, err)
+		e.dataAge.DeleteLabelValues(worker)
+		return
+	}
+	e.dataAge.WithLabelValues(worker).Set(now.Sub(t).Seconds())
+}
+
+// setQueuedSizeGrowth sets buffer_queued_size_growth_bytes_per_second from the
+// buffer_total_queued_size delta since the previous scrape.
+func (e *Exporter) setQueuedSizeGrowth(state *pluginState, plugin Plugin, labels prometheus.Labels) {
+	size, at := *plugin.BufTotalQueuedSize, plugin.ScrapedAt
+	if !state.queuedTime.IsZero() {
+		if elapsed := at.Sub(state.queuedTime).Seconds(); elapsed > 0 {
+			e.setPluginMetric("buffer_queued_size_growth_bytes_per_second", labels, e.scaleBytes(size - state.queuedSize) / elapsed)
+		}
+	}
+	state.queuedSize, state.queuedTime = size, at
+}
+
+// setEmitRate sets plugin_emit_rate from the emit_count delta since the previous
+// scrape. This is a two-point approximation: it needs two scrapes before it has a
+// value and is only as fine-grained as the scrape interval. When emit_count goes
+// backwards (plugin restart) the series keeps its last value until the next scrape.
+func (e *Exporter) setEmitRate(state *pluginState, plugin Plugin, labels prometheus.Labels) {
+	count, at := *plugin.EmitCount, plugin.ScrapedAt
+	if !state.emitTime.IsZero() && count >= state.emitCount {
+		if elapsed := at.Sub(state.emitTime).Seconds(); elapsed > 0 {
+			rate := (count - state.emitCount) / elapsed
+			e.setPluginMetric("plugin_emit_rate", labels, rate)
+
+			if state.hasRate {
+				rate = emitRateAlpha * rate + (1 - emitRateAlpha) * state.emitRateEMA
+			}
+			state.emitRateEMA, state.hasRate = rate, true
+		}
+	}
+	state.emitCount, state.emitTime = count, at
+
+	e.setDrainEstimate(state, plugin, labels)
+}
+
+// setDrainEstimate sets buffer_estimated_drain_seconds as buffer_queue_length
+// divided by the smoothed emit rate. It treats the emit rate as a stand-in for
+// the flush throughput and queued chunks as a proxy for backlog, so it is only
+// a trend signal, not an exact time. The series is dropped while the rate is
+// below minEmitRate, where the estimate is meaningless.
+func (e *Exporter) setDrainEstimate(state *pluginState, plugin Plugin, labels prometheus.Labels) {
+	if !state.hasRate || state.emitRateEMA < minEmitRate {
+		e.deletePluginMetric("buffer_estimated_drain_seconds", labels)
+		return
+	}
+	e.setPluginMetric("buffer_estimated_drain_seconds", labels, plugin.QueueLength() / state.emitRateEMA)
+}
+
+// pluginLabels returns the labels of the per-plugin metrics of plugin.
+func (e *Exporter) pluginLabels(plugin Plugin) prometheus.Labels {
+	labels := prometheus.Labels{
+		e.typeLabel: plugin.PluginType,
+		e.idLabel: plugin.PluginId,
+		"worker": plugin.Worker,
+	}
+	e.addIDLabels(labels, plugin.PluginId)
+	return labels
+}
+
+// addIDLabels adds the named groups of the id label template to labels. A
+// pluginId that does not match gets empty values, keeping only the raw id.
+// With ExporterOpts.NamespaceFromIDPrefix it also adds logical_namespace,
+// empty for ids without an underscore.
+func (e *Exporter) addIDLabels(labels prometheus.Labels, pluginId string) {
+	if e.namespaceFromIDPrefix {
+		labels["logical_namespace"] = ""
+		if i := strings.Index(pluginId, "_"); i > 0 {
+			labels["logical_namespace"] = pluginId[:i]
+		}
+	}
+	if e.idLabelTemplate == nil {
+		return
+	}
+	match := e.idLabelTemplate.FindStringSubmatch(pluginId)
+	for i, name := range e.idLabelTemplate.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		labels[name] = ""
+		if match != nil {
+			labels[name] = match[i]
+		}
+	}
+}
+
+// setBufferMetric sets one of bufferMetrics. With ExporterOpts.ZeroMissing
+// these carry a buffered label, so the zeros of non-buffered plugins can be
+// told apart from empty buffers.
+func (e *Exporter) setBufferMetric(name string, labels prometheus.Labels, buffered string, value float64) {
+	if !e.zeroMissing {
+		e.setPluginMetric(name, labels, value)
+		return
+	}
+
+	e.setPluginMetric(name, withLabels(labels, "buffered", buffered), value)
+}
+
+// withLabels returns a copy of labels with the given name/value pairs added.
+func withLabels(labels prometheus.Labels, nameValues ...string) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels) + len(nameValues) / 2)
+	for k, v := range labels {
+		l[k] = v
+	}
+	for i := 0; i + 1 < len(nameValues); i += 2 {
+		l[nameValues[i]] = nameValues[i + 1]
+	}
+	return l
+}
+
+// setPluginMetric sets the named plugin metric, doing nothing when it is not enabled.
+func (e *Exporter) setPluginMetric(name string, labels prometheus.Labels, value float64) {
+	m, ok := e.pluginMetrics[name]
+	if !ok {
+		return
+	}
+	if e.typeInName {
+		e.typedMetric(name, labels[e.typeLabel]).With(withoutLabel(labels, e.typeLabel)).Set(value)
+		return
+	}
+	m.With(labels).Set(value)
+}
+
+// deletePluginMetric drops the series of the named plugin metric with labels.
+func (e *Exporter) deletePluginMetric(name string, labels prometheus.Labels) {
+	m, ok := e.pluginMetrics[name]
+	if !ok {
+		return
+	}
+	if e.typeInName {
+		if typed, ok := e.typedMetrics[e.typedMetricName(name, labels[e.typeLabel])]; ok {
+			typed.Delete(withoutLabel(labels, e.typeLabel))
+		}
+		return
+	}
+	m.Delete(labels)
+}
+
+func stringSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
@@ -0,0 +1,1509 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pluginsJSON is a /api/plugins.json response with a buffered output, an
+// input and an unbuffered output without @id.
+const pluginsJSON = `{"plugins":[
+	{"plugin_id":"out_s3","plugin_category":"output","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_total_queued_size":2048,"retry_count":1},
+	{"plugin_id":"in_forward","plugin_category":"input","type":"forward","output_plugin":false,"retry_count":0},
+	{"plugin_id":"object:3fe","plugin_category":"output","type":"stdout","output_plugin":true,"retry_count":0}
+]}`
+
+// newAgent starts a mock monitor agent answering /api/plugins.json with body.
+func newAgent(body string) *httptest.Server {
+	return httptest.NewServer(agentHandler(body))
+}
+
+func agentHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/plugins.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}
+}
+
+// flakyAgent starts a mock monitor agent answering with pluginsJSON, or with
+// 503 while the returned flag is 1.
+func flakyAgent(t testing.TB) (*httptest.Server, *int32) {
+	t.Helper()
+	fail := new(int32)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(fail) == 1 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	return agent, fail
+}
+
+func newTestExporter(t testing.TB, opts ExporterOpts) *Exporter {
+	if opts.Namespace == "" {
+		opts.Namespace = "fluentd"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	e, err := NewExporter(opts)
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	return e
+}
+
+// collect gathers c and returns every sample by its series, e.g.
+// fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}.
+// Histograms are reported by their sample count.
+func collect(t testing.TB, c prometheus.Collector) map[string]float64 {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %s", err)
+	}
+
+	samples := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			sort.Strings(labels)
+			series := mf.GetName() + "{" + strings.Join(labels, ",") + "}"
+			switch {
+			case m.Gauge != nil:
+				samples[series] = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				samples[series] = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				samples[series] = m.GetUntyped().GetValue()
+			case m.Histogram != nil:
+				samples[series] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return samples
+}
+
+// expectSamples fails t for every series of want that is missing from got or
+// has another value.
+func expectSamples(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	for series, value := range want {
+		v, ok := got[series]
+		if !ok {
+			t.Errorf("missing %s", series)
+		} else if v != value {
+			t.Errorf("%s = %g, want %g", series, v, value)
+		}
+	}
+}
+
+// seriesOf returns the series of got of the metric name.
+func seriesOf(got map[string]float64, name string) []string {
+	var series []string
+	for s := range got {
+		if strings.HasPrefix(s, name + "{") {
+			series = append(series, s)
+		}
+	}
+	sort.Strings(series)
+	return series
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// applyPlugins applies a successful scrape finding plugins, without fetching.
+func applyPlugins(e *Exporter, plugins ...Plugin) {
+	e.Lock()
+	defer e.Unlock()
+	e.apply(&snapshot{plugins: plugins, categories: map[string]int{}})
+}
+
+// labelValue returns the value of the label name in a series of collect.
+func labelValue(series, name string) string {
+	i := strings.Index(series, name + `="`)
+	if i < 0 {
+		return ""
+	}
+	value := series[i + len(name) + 2:]
+	return value[:strings.Index(value, `"`)]
+}
+
+// waitFor polls cond until it holds, failing t after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestMultipleWorkerEndpoints(t *testing.T) {
+	worker0 := newAgent(`{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":10,"retry_count":0}]}`)
+	defer worker0.Close()
+	worker1 := newAgent(`{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":2,"buffer_total_queued_size":20,"retry_count":4}]}`)
+	defer worker1.Close()
+
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints: []string{worker0.URL, worker1.URL},
+		Metrics:   []string{"buffer_queue_length", "retry_count"},
+	})
+	got := collect(t, e)
+
+	host0 := strings.TrimPrefix(worker0.URL, "http://")
+	host1 := strings.TrimPrefix(worker1.URL, "http://")
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker="` + host0 + `"}`: 1,
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker="` + host1 + `"}`: 2,
+		`fluentd_retry_count{pluginId="out_s3",pluginType="s3",worker="` + host0 + `"}`:         0,
+		`fluentd_retry_count{pluginId="out_s3",pluginType="s3",worker="` + host1 + `"}`:         4,
+		`fluentd_last_scrape_error{}`: 0,
+	})
+	if n := len(seriesOf(got, "fluentd_buffer_queue_length")); n != 2 {
+		t.Errorf("got %d buffer_queue_length series, want 2", n)
+	}
+}
+
+func TestWorkerLabels(t *testing.T) {
+	worker0 := newAgent(`{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":10,"retry_count":0}]}`)
+	defer worker0.Close()
+	worker1 := newAgent(`{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":2,"buffer_total_queued_size":20,"retry_count":4}]}`)
+	defer worker1.Close()
+
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints:    []string{worker0.URL, worker1.URL},
+		WorkerLabels: []string{"0", "1"},
+		Metrics:      []string{"buffer_queue_length"},
+	})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker="0"}`: 1,
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker="1"}`: 2,
+	})
+}
+
+func TestDuplicateEndpoints(t *testing.T) {
+	endpoints := []string{"http://localhost:24220", "http://localhost:24220"}
+	if _, err := NewExporter(ExporterOpts{Endpoints: endpoints}); err == nil {
+		t.Error("NewExporter accepted an endpoint twice")
+	}
+	if _, err := NewExporter(ExporterOpts{Endpoints: endpoints, WorkerLabels: []string{"0", "1"}}); err == nil {
+		t.Error("NewExporter accepted an endpoint twice with worker labels")
+	}
+}
+
+func TestSingleEndpointHasEmptyWorker(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+}
+
+func TestActiveScrapes(t *testing.T) {
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+
+	// The agent hangs until it is released.
+	done := make(chan struct{})
+	go func() {
+		e.Collect(make(chan prometheus.Metric, 100))
+		close(done)
+	}()
+	waitFor(t, "the hanging scrape", func() bool { return testutil.ToFloat64(e.activeScrapes) == 1 })
+	close(release)
+	<-done
+	if got := testutil.ToFloat64(e.activeScrapes); got != 0 {
+		t.Errorf("exporter_active_scrapes = %g after the scrape, want 0", got)
+	}
+
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_exporter_active_scrapes{}`: 0,
+		`fluentd_last_scrape_error{}`:       0,
+	})
+}
+
+func TestEnabledMetrics(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"retry_count"}})
+	got := collect(t, e)
+
+	expectSamples(t, got, map[string]float64{
+		`fluentd_retry_count{pluginId="out_s3",pluginType="s3",worker=""}`: 1,
+	})
+	for _, name := range []string{"fluentd_buffer_queue_length", "fluentd_buffer_total_queued_size"} {
+		if series := seriesOf(got, name); len(series) > 0 {
+			t.Errorf("got %s while only retry_count is enabled", series)
+		}
+	}
+}
+
+func TestUnknownMetric(t *testing.T) {
+	if _, err := NewExporter(ExporterOpts{Metrics: []string{"buffer_queue_length", "bogus"}}); err == nil {
+		t.Error("NewExporter accepted an unknown metric")
+	}
+}
+
+func TestBufferPendingTotal(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_stage_length":4,"buffer_total_queued_size":10,"retry_count":0},
+		{"plugin_id":"out_old","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_total_queued_size":10,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_pending_total"}})
+	got := collect(t, e)
+
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_pending_total{pluginId="out_s3",pluginType="s3",worker=""}`: 7,
+	})
+	// Without buffer_stage_length, e.g. from v0.12, there is nothing to add.
+	if _, ok := got[`fluentd_buffer_pending_total{pluginId="out_old",pluginType="s3",worker=""}`]; ok {
+		t.Error("got buffer_pending_total for a plugin without buffer_stage_length")
+	}
+}
+
+func TestPluginTypeAllowDeny(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0},
+		{"plugin_id":"out_es","type":"elasticsearch","output_plugin":true,"buffer_queue_length":2,"retry_count":0},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		want        []string
+	}{
+		{"all", nil, nil, []string{"out_es", "out_s3", "out_stdout"}},
+		{"allow", []string{"s3", "elasticsearch"}, nil, []string{"out_es", "out_s3"}},
+		{"deny", nil, []string{"stdout"}, []string{"out_es", "out_s3"}},
+		{"deny overrides allow", []string{"s3", "elasticsearch"}, []string{"s3"}, []string{"out_es"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestExporter(t, ExporterOpts{
+				Endpoints:       []string{agent.URL},
+				Metrics:         []string{"retry_count"},
+				PluginTypeAllow: tc.allow,
+				PluginTypeDeny:  tc.deny,
+			})
+			var ids []string
+			for _, series := range seriesOf(collect(t, e), "fluentd_retry_count") {
+				ids = append(ids, labelValue(series, "pluginId"))
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("got plugins %v, want %v", ids, tc.want)
+			}
+		})
+	}
+}
+
+func TestScrapeCache(t *testing.T) {
+	var fetches int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, CacheTTL: time.Minute})
+	collect(t, e)
+	got := collect(t, e)
+
+	expectSamples(t, got, map[string]float64{
+		`fluentd_scrape_cache_misses_total{}`: 1,
+		`fluentd_scrape_cache_hits_total{}`:   1,
+	})
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("agent was fetched %d times, want 1", n)
+	}
+}
+
+// downURL returns the URL of a server that is no longer listening.
+func downURL() string {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s.URL
+}
+
+func TestFallbackEndpoint(t *testing.T) {
+	fallback := newAgent(pluginsJSON)
+	defer fallback.Close()
+
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints: []string{downURL()},
+		Fallback:  fallback.URL,
+		Metrics:   []string{"buffer_queue_length"},
+	})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_active_endpoint_is_fallback{}`:                                    1,
+		`fluentd_last_scrape_error{}`:                                              0,
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+}
+
+func TestFallbackEndpointDown(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{downURL()}, Fallback: downURL()})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_active_endpoint_is_fallback{}`: 0,
+		`fluentd_last_scrape_error{}`:           1,
+	})
+}
+
+func TestEmitRate(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"plugin_emit_rate"}})
+	start := time.Now()
+	scraped := func(emitCount float64, at time.Duration) Plugin {
+		return Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true, EmitCount: float(emitCount), ScrapedAt: start.Add(at)}
+	}
+	rate := e.pluginMetrics["plugin_emit_rate"]
+	const series = `fluentd_plugin_emit_rate{pluginId="out_s3",pluginType="s3",worker=""}`
+
+	applyPlugins(e, scraped(100, 0))
+	if _, ok := collect(t, rate)[series]; ok {
+		t.Error("got an emit rate after a single scrape")
+	}
+
+	applyPlugins(e, scraped(400, 10 * time.Second))
+	expectSamples(t, collect(t, rate), map[string]float64{series: 30})
+
+	// emit_count going backwards is a restart, not a negative rate.
+	applyPlugins(e, scraped(50, 20 * time.Second))
+	expectSamples(t, collect(t, rate), map[string]float64{series: 30})
+
+	applyPlugins(e, scraped(150, 30 * time.Second))
+	expectSamples(t, collect(t, rate), map[string]float64{series: 10})
+}
+
+func TestForgetRemovedPlugins(t *testing.T) {
+	down := newAgent(pluginsJSON)
+	down.Close()
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{down.URL}})
+	s3 := Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true}
+	es := Plugin{PluginId: "out_es", PluginType: "elasticsearch", OutputPlugin: true}
+
+	applyPlugins(e, s3, es)
+	// A failed scrape doesn't tell which plugins are gone.
+	collect(t, e)
+	if len(e.pluginStates) != 2 {
+		t.Errorf("got %d plugin states for 2 plugins after a failed scrape", len(e.pluginStates))
+	}
+
+	s3.PluginType = "s3_v2"
+	applyPlugins(e, s3, es)
+	expectSamples(t, collect(t, e.typeChanges), map[string]float64{
+		`fluentd_plugin_type_changes_total{pluginId="out_s3",worker=""}`: 1,
+	})
+
+	applyPlugins(e, es)
+	if len(e.pluginStates) != 1 {
+		t.Errorf("got %d plugin states for 1 plugin", len(e.pluginStates))
+	}
+	if series := seriesOf(collect(t, e.typeChanges), "fluentd_plugin_type_changes_total"); len(series) > 0 {
+		t.Errorf("got %v for a removed plugin", series)
+	}
+}
+
+func TestIDLabelTemplate(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3.prod.billing","type":"s3","output_plugin":true,"retry_count":1},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":2}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints:       []string{agent.URL},
+		Metrics:         []string{"retry_count"},
+		IDLabelTemplate: `^out_\w+\.(?P<env>\w+)\.(?P<app>\w+)$`,
+	})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_retry_count{app="billing",env="prod",pluginId="out_s3.prod.billing",pluginType="s3",worker=""}`: 1,
+		// Non-matching ids keep only the raw id.
+		`fluentd_retry_count{app="",env="",pluginId="out_stdout",pluginType="stdout",worker=""}`: 2,
+	})
+}
+
+func TestNewExporterDefaults(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e, err := NewExporter(ExporterOpts{Endpoints: []string{agent.URL}})
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	collect(t, e)
+	if up := testutil.ToFloat64(e.up); up != 1 {
+		t.Errorf("up = %g with the default timeout, want 1", up)
+	}
+	for _, name := range defaultMetrics {
+		if _, ok := e.pluginMetrics[name]; !ok {
+			t.Errorf("default metric %s not exposed", name)
+		}
+	}
+}
+
+func TestLabelNamesHaveBucketLabel(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{})
+	for _, name := range e.LabelNames() {
+		if name == "le" {
+			return
+		}
+	}
+	t.Errorf("LabelNames() = %v, want le of the lock wait histogram among them", e.LabelNames())
+}
+
+func TestIDLabelTemplateConflict(t *testing.T) {
+	if _, err := NewExporter(ExporterOpts{IDLabelTemplate: `(?P<worker>\d+)`}); err == nil {
+		t.Error("NewExporter accepted a template group named like an existing label")
+	}
+	// Labels only some metrics carry.
+	for _, group := range []string{"mode", "buffered", "retry_wait", "cause"} {
+		if _, err := NewExporter(ExporterOpts{IDLabelTemplate: `(?P<` + group + `>\w+)`}); err == nil {
+			t.Errorf("NewExporter accepted the template group %q", group)
+		}
+	}
+	_, err := NewExporter(ExporterOpts{IDLabelTemplate: `(?P<logical_namespace>\w+)`, NamespaceFromIDPrefix: true})
+	if err == nil || !strings.Contains(err.Error(), "template group") {
+		t.Errorf("NewExporter with a logical_namespace group and NamespaceFromIDPrefix: %v", err)
+	}
+	if _, err := NewExporter(ExporterOpts{IDLabelTemplate: `(?P<logical_namespace>\w+)`}); err != nil {
+		t.Errorf("NewExporter rejected a logical_namespace group without NamespaceFromIDPrefix: %s", err)
+	}
+	if _, err := NewExporter(ExporterOpts{IDLabelTemplate: `(`}); err == nil {
+		t.Error("NewExporter accepted an invalid template")
+	}
+}
+
+func TestTotalQueuedSizeAll(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_a","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0},
+		{"plugin_id":"out_b","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":250,"retry_count":0},
+		{"plugin_id":"out_c","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_buffer_total_queued_size_all{}`: 350,
+	})
+}
+
+func TestDistinctPluginTypes(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_a","type":"s3","output_plugin":true,"retry_count":0},
+		{"plugin_id":"out_b","type":"s3","output_plugin":true,"retry_count":0},
+		{"plugin_id":"out_c","type":"elasticsearch","output_plugin":true,"retry_count":0},
+		{"plugin_id":"out_d","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_distinct_plugin_types{}`: 3,
+	})
+}
+
+func TestAvgBufferQueueLengthByType(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3_a","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0},
+		{"plugin_id":"out_s3_b","type":"s3","output_plugin":true,"buffer_queue_length":4,"retry_count":0},
+		{"plugin_id":"out_s3_c","type":"s3","output_plugin":true,"buffer_queue_length":7,"retry_count":0},
+		{"plugin_id":"out_es_a","type":"elasticsearch","output_plugin":true,"buffer_queue_length":0,"retry_count":0},
+		{"plugin_id":"out_es_b","type":"elasticsearch","output_plugin":true,"buffer_queue_length":3,"retry_count":0},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	got := collect(t, newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}}))
+	expectSamples(t, got, map[string]float64{
+		`fluentd_avg_buffer_queue_length_by_type{pluginType="s3"}`:            4,
+		`fluentd_avg_buffer_queue_length_by_type{pluginType="elasticsearch"}`: 1.5,
+	})
+	// Non-buffered plugins have no queue to average.
+	if series := seriesOf(got, "fluentd_avg_buffer_queue_length_by_type"); len(series) != 2 {
+		t.Errorf("got %v, want s3 and elasticsearch only", series)
+	}
+}
+
+func TestSnakeCaseLabels(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, SnakeCaseLabels: true})
+	got := collect(t, e)
+
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_queue_length{plugin_id="out_s3",plugin_type="s3",worker=""}`: 3,
+		`fluentd_slowest_plugin_info{plugin_id="out_s3",plugin_type="s3",worker=""}`: 1,
+	})
+	for series := range got {
+		if strings.Contains(series, "pluginId") || strings.Contains(series, "pluginType") {
+			t.Errorf("got camelCase label in %s", series)
+		}
+	}
+}
+
+func TestLastScrapeErrorInfo(t *testing.T) {
+	fail := int32(1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_last_scrape_error_info{message="unexpected status 503 Service Unavailable"}`: 1,
+	})
+
+	atomic.StoreInt32(&fail, 0)
+	if series := seriesOf(collect(t, e), "fluentd_last_scrape_error_info"); len(series) > 0 {
+		t.Errorf("got %v after a successful scrape", series)
+	}
+}
+
+func TestScrapeSuccessTotal(t *testing.T) {
+	agent, fail := flakyAgent(t)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	for _, failing := range []int32{0, 1, 0, 0, 1} {
+		atomic.StoreInt32(fail, failing)
+		e.Scrape()
+	}
+	expectSamples(t, collect(t, e), map[string]float64{
+		// The collect scrapes once more, failing.
+		`fluentd_scrapes_total{}`:        6,
+		`fluentd_scrape_errors_total{}`:  3,
+		`fluentd_scrape_success_total{}`: 3,
+	})
+
+	// A scrape failing for one of several endpoints is not a success.
+	down := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL, downURL()}})
+	atomic.StoreInt32(fail, 0)
+	down.Scrape()
+	if successes := testutil.ToFloat64(down.totalSuccesses); successes != 0 {
+		t.Errorf("scrape_success_total %g after a partly failed scrape, want 0", successes)
+	}
+}
+
+func TestHoldLastGood(t *testing.T) {
+	agent, fail := flakyAgent(t)
+	defer agent.Close()
+
+	for _, hold := range []bool{true, false} {
+		atomic.StoreInt32(fail, 0)
+		e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, HoldLastGood: hold})
+		expectSamples(t, collect(t, e), map[string]float64{`fluentd_up{}`: 1})
+
+		atomic.StoreInt32(fail, 1)
+		got := collect(t, e)
+		want := map[string]float64{
+			`fluentd_up{}`:                           0,
+			`fluentd_last_scrape_error{}`:            1,
+			`fluentd_buffer_total_queued_size_all{}`: 0,
+			`fluentd_plugins_without_explicit_id{}`:  0,
+		}
+		if hold {
+			want[`fluentd_buffer_total_queued_size_all{}`] = 2048
+			want[`fluentd_plugins_without_explicit_id{}`] = 1
+			want[`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`] = 3
+			want[`fluentd_output_plugin_mode{mode="buffered",pluginId="out_s3",pluginType="s3",worker=""}`] = 1
+		}
+		expectSamples(t, got, want)
+		if series := seriesOf(got, "fluentd_buffer_queue_length"); !hold && len(series) > 0 {
+			t.Errorf("got %v after a failed scrape without HoldLastGood", series)
+		}
+	}
+}
+
+func TestRemovedPluginSeriesDropped(t *testing.T) {
+	plugin := func(id string) Plugin {
+		return Plugin{PluginId: id, PluginType: "s3", OutputPlugin: true, BufQueueLength: float(1), RetryCount: 2}
+	}
+	for _, typeInName := range []bool{false, true} {
+		// The cache keeps collect from scraping over the applied plugins.
+		e := newTestExporter(t, ExporterOpts{Metrics: []string{"buffer_queue_length", "retry_count"}, TypeInName: typeInName, CacheTTL: time.Hour})
+		applyPlugins(e, plugin("out_kept"), plugin("out_removed"))
+		e.lastScrape = time.Now()
+		removed := func() []string {
+			var series []string
+			for s := range collect(t, e) {
+				if labelValue(s, "pluginId") == "out_removed" {
+					series = append(series, s)
+				}
+			}
+			return series
+		}
+		if len(removed()) == 0 {
+			t.Fatal("got no series of out_removed while it is reported")
+		}
+
+		applyPlugins(e, plugin("out_kept"))
+		if series := removed(); len(series) > 0 {
+			t.Errorf("type in name %t: got %v after out_removed was no longer reported", typeInName, series)
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{})
+	for _, tc := range []struct {
+		err  string
+		want string
+	}{
+		{"unexpected status 503", "unexpected status 503"},
+		{"line\nbreak", "line break"},
+		{
+			`Get "http://10.0.0.1:24220/api/plugins.json": read tcp 127.0.0.1:54321->10.0.0.1:24220: i/o timeout`,
+			`Get "http://10.0.0.1:24220/api/plugins.json": read tcp 10.0.0.1:24220: i/o timeout`,
+		},
+		{"retry at 2026-10-14T17:12:44Z failed", "retry at <time> failed"},
+		{strings.Repeat("x", 300), strings.Repeat("x", maxErrorMessageLength)},
+	} {
+		if got := e.errorMessage(fmt.Errorf("%s", tc.err)); got != tc.want {
+			t.Errorf("errorMessage(%q) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestErrorMessageCap(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{})
+	// Every connection has another local port, which must not use up the cap.
+	for port := 50000; port < 50000 + 2 * maxErrorMessages; port++ {
+		err := fmt.Errorf("read tcp 127.0.0.1:%d->10.0.0.1:24220: connection reset by peer", port)
+		if got := e.errorMessage(err); got == "other" {
+			t.Fatalf("message of the same error from port %d reported as other", port)
+		}
+	}
+
+	for i := 0; i < 2 * maxErrorMessages; i++ {
+		e.errorMessage(fmt.Errorf("error %d", i))
+	}
+	if got := e.errorMessage(fmt.Errorf("yet another error")); got != "other" {
+		t.Errorf("got %q once %d messages were used, want other", got, maxErrorMessages)
+	}
+	if len(e.errorMessages) != maxErrorMessages {
+		t.Errorf("remembered %d messages, want %d", len(e.errorMessages), maxErrorMessages)
+	}
+}
+
+func TestSlowestPluginInfo(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_a","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0},
+		{"plugin_id":"out_b","type":"elasticsearch","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":900,"retry_count":0},
+		{"plugin_id":"out_c","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":300,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	got := seriesOf(collect(t, e), "fluentd_slowest_plugin_info")
+	want := `fluentd_slowest_plugin_info{pluginId="out_b",pluginType="elasticsearch",worker=""}`
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestScrapeDurationPositive(t *testing.T) {
+	agent := newAgent(`{"plugins":[]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	d := collect(t, e)[`fluentd_last_scrape_duration_seconds{}`]
+	if d <= 0 || d > 1 {
+		t.Errorf("last_scrape_duration_seconds = %g for a near-instant agent, want a small positive duration", d)
+	}
+}
+
+func TestPluginsByCategory(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"in_forward","plugin_category":"input","type":"forward","output_plugin":false,"retry_count":0},
+		{"plugin_id":"in_tail","plugin_category":"input","type":"tail","output_plugin":false,"retry_count":0},
+		{"plugin_id":"filter_grep","plugin_category":"filter","type":"grep","output_plugin":false,"retry_count":0},
+		{"plugin_id":"out_s3","plugin_category":"output","type":"s3","output_plugin":true,"retry_count":0},
+		{"plugin_id":"out_stdout","plugin_category":"output","type":"stdout","output_plugin":true,"retry_count":0},
+		{"plugin_id":"out_null","plugin_category":"output","type":"null","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_plugins_by_category{category="input"}`:  2,
+		`fluentd_plugins_by_category{category="filter"}`: 1,
+		`fluentd_plugins_by_category{category="output"}`: 3,
+	})
+}
+
+func TestDrainEstimate(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"buffer_estimated_drain_seconds"}})
+	start := time.Now()
+	scraped := func(emitCount, queue float64, at time.Duration) Plugin {
+		return Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true, EmitCount: float(emitCount), BufQueueLength: float(queue), ScrapedAt: start.Add(at)}
+	}
+	drain := e.pluginMetrics["buffer_estimated_drain_seconds"]
+	const series = `fluentd_buffer_estimated_drain_seconds{pluginId="out_s3",pluginType="s3",worker=""}`
+
+	applyPlugins(e, scraped(0, 50, 0))
+	if _, ok := collect(t, drain)[series]; ok {
+		t.Error("got a drain estimate without an emit rate")
+	}
+
+	// 10 emits per second, 50 chunks queued.
+	applyPlugins(e, scraped(100, 50, 10 * time.Second))
+	expectSamples(t, collect(t, drain), map[string]float64{series: 5})
+
+	// No emits: the smoothed rate drops to 0.3 * 0 + 0.7 * 10 = 7.
+	applyPlugins(e, scraped(100, 70, 20 * time.Second))
+	expectSamples(t, collect(t, drain), map[string]float64{series: 10})
+}
+
+func TestDrainEstimateZeroRate(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"buffer_estimated_drain_seconds"}})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		applyPlugins(e, Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true, EmitCount: float(0), BufQueueLength: float(5), ScrapedAt: start.Add(time.Duration(i) * 10 * time.Second)})
+	}
+	if v, ok := collect(t, e.pluginMetrics["buffer_estimated_drain_seconds"])[`fluentd_buffer_estimated_drain_seconds{pluginId="out_s3",pluginType="s3",worker=""}`]; ok {
+		t.Errorf("got a drain estimate of %g while nothing is emitted", v)
+	}
+}
+
+func TestDrainEstimateDroppedWhenEmitsStop(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"buffer_estimated_drain_seconds"}})
+	start := time.Now()
+	scraped := func(emitCount float64, at time.Duration) Plugin {
+		return Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true, EmitCount: float(emitCount), BufQueueLength: float(5), ScrapedAt: start.Add(at)}
+	}
+	drain := e.pluginMetrics["buffer_estimated_drain_seconds"]
+	const series = `fluentd_buffer_estimated_drain_seconds{pluginId="out_s3",pluginType="s3",worker=""}`
+
+	applyPlugins(e, scraped(0, 0))
+	applyPlugins(e, scraped(100, 10 * time.Second))
+	if _, ok := collect(t, drain)[series]; !ok {
+		t.Fatal("no drain estimate while emitting")
+	}
+
+	// Without emits the smoothed rate decays by 0.7 per scrape: below
+	// minEmitRate after 26 scrapes.
+	for i := 2; i < 40; i++ {
+		applyPlugins(e, scraped(100, time.Duration(i) * 10 * time.Second))
+	}
+	if v, ok := collect(t, drain)[series]; ok {
+		t.Errorf("drain estimate of %g survived the emit rate dropping to zero", v)
+	}
+}
+
+func TestConcurrentCollect(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	// Serialized, 8 scrapes would take 8 delays.
+	const scrapes = 8
+	start := time.Now()
+	errs := make(chan error, scrapes)
+	for i := 0; i < scrapes; i++ {
+		go func() {
+			_, err := reg.Gather()
+			errs <- err
+		}()
+	}
+	for i := 0; i < scrapes; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Gather: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 4 * delay {
+		t.Errorf("%d concurrent scrapes took %s, want about %s", scrapes, elapsed, delay)
+	}
+
+	// The lock isn't held while the next scrape is in flight.
+	go e.Scrape()
+	time.Sleep(delay / 4)
+	start = time.Now()
+	e.RLock()
+	e.RUnlock()
+	if elapsed := time.Since(start); elapsed > delay / 2 {
+		t.Errorf("locking during a scrape took %s, want it not to wait for the scrape", elapsed)
+	}
+}
+
+func TestIdlePlugins(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{})
+	start := time.Now()
+	plugins := func(flat, increasing float64, at time.Duration) []Plugin {
+		return []Plugin{
+			{PluginId: "out_flat", PluginType: "s3", OutputPlugin: true, EmitCount: float(flat), ScrapedAt: start.Add(at)},
+			{PluginId: "out_busy", PluginType: "s3", OutputPlugin: true, EmitCount: float(increasing), ScrapedAt: start.Add(at)},
+		}
+	}
+
+	// Nothing to compare with on the first scrape.
+	applyPlugins(e, plugins(10, 10, 0)...)
+	if got := testutil.ToFloat64(e.idlePlugins); got != 0 {
+		t.Errorf("idle_plugins %v, want 0", got)
+	}
+
+	applyPlugins(e, plugins(10, 20, 10 * time.Second)...)
+	if got := testutil.ToFloat64(e.idlePlugins); got != 1 {
+		t.Errorf("idle_plugins %v, want 1", got)
+	}
+
+	// A reset of emit_count is a restart, not idleness.
+	applyPlugins(e, plugins(10, 5, 20 * time.Second)...)
+	if got := testutil.ToFloat64(e.idlePlugins); got != 1 {
+		t.Errorf("idle_plugins %v, want 1", got)
+	}
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	plugin := func(id string) Plugin {
+		return Plugin{PluginId: id, PluginType: "s3", OutputPlugin: true, BufQueueLength: float(1), BufTotalQueuedSize: float(500)}
+	}
+	orders := [][]string{
+		{"out_a", "out_b", "out_c"},
+		{"out_c", "out_a", "out_b"},
+		{"out_b", "out_c", "out_a"},
+	}
+
+	var first map[string]float64
+	for _, order := range orders {
+		// The cache keeps collect from scraping over the applied plugins.
+		e := newTestExporter(t, ExporterOpts{CacheTTL: time.Hour})
+		var plugins []Plugin
+		for _, id := range order {
+			plugins = append(plugins, plugin(id))
+		}
+		applyPlugins(e, plugins...)
+		e.lastScrape = time.Now()
+		got := collect(t, e)
+
+		// Ties go to the first pluginId, whatever order the agent reported.
+		slowest := seriesOf(got, "fluentd_slowest_plugin_info")
+		if len(slowest) != 1 || labelValue(slowest[0], "pluginId") != "out_a" {
+			t.Errorf("order %v: slowest_plugin_info %v, want out_a", order, slowest)
+		}
+		if first == nil {
+			first = got
+			continue
+		}
+		for series, v := range first {
+			if got[series] != v {
+				t.Errorf("order %v: %s = %g, want %g as for order %v", order, series, got[series], v, orders[0])
+			}
+		}
+	}
+}
+
+func TestWorkerFetchDuration(t *testing.T) {
+	slowAgent := func(delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			agentHandler(pluginsJSON)(w, r)
+		}))
+	}
+	fast := slowAgent(0)
+	defer fast.Close()
+	slow := slowAgent(200 * time.Millisecond)
+	defer slow.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{fast.URL, slow.URL}})
+	got := collect(t, e)
+	fastDuration := got[`fluentd_worker_fetch_duration_seconds{worker="` + strings.TrimPrefix(fast.URL, "http://") + `"}`]
+	slowDuration := got[`fluentd_worker_fetch_duration_seconds{worker="` + strings.TrimPrefix(slow.URL, "http://") + `"}`]
+	if fastDuration <= 0 || fastDuration >= 0.2 {
+		t.Errorf("fetch duration of the fast worker = %g, want under 0.2", fastDuration)
+	}
+	if slowDuration < 0.2 {
+		t.Errorf("fetch duration of the slow worker = %g, want at least 0.2", slowDuration)
+	}
+}
+
+func TestZeroMissing(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+	metrics := []string{"buffer_queue_length", "buffer_total_queued_size"}
+
+	skip := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: metrics})
+	got := collect(t, skip)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+	for _, series := range seriesOf(got, "fluentd_buffer_queue_length") {
+		if labelValue(series, "pluginId") == "object:3fe" {
+			t.Errorf("got %s for a non-buffered plugin by default", series)
+		}
+	}
+
+	zero := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: metrics, ZeroMissing: true})
+	expectSamples(t, collect(t, zero), map[string]float64{
+		`fluentd_buffer_queue_length{buffered="true",pluginId="out_s3",pluginType="s3",worker=""}`:               3,
+		`fluentd_buffer_total_queued_size{buffered="true",pluginId="out_s3",pluginType="s3",worker=""}`:          2048,
+		`fluentd_buffer_queue_length{buffered="false",pluginId="object:3fe",pluginType="stdout",worker=""}`:      0,
+		`fluentd_buffer_total_queued_size{buffered="false",pluginId="object:3fe",pluginType="stdout",worker=""}`: 0,
+	})
+}
+
+func TestLockWait(t *testing.T) {
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	// One gather scrapes while the others wait for it, until the agent is
+	// released.
+	const gathers, held = 4, 100 * time.Millisecond
+	errs := make(chan error, gathers)
+	for i := 0; i < gathers; i++ {
+		go func() {
+			_, err := reg.Gather()
+			errs <- err
+		}()
+	}
+	waitFor(t, "every gather to wait for the scrape in flight", func() bool {
+		return testutil.ToFloat64(e.coalescedScrapes) == gathers - 1
+	})
+	time.Sleep(held)
+	close(release)
+	for i := 0; i < gathers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Gather: %s", err)
+		}
+	}
+
+	var m dto.Metric
+	if err := e.lockWait.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	h := m.GetHistogram()
+	if h.GetSampleCount() != gathers {
+		t.Errorf("collect_lock_wait_seconds has %d samples, want %d", h.GetSampleCount(), gathers)
+	}
+	// The waiting gathers waited for at least held each.
+	if want := (gathers - 1) * held.Seconds(); h.GetSampleSum() < want {
+		t.Errorf("collect_lock_wait_seconds sums to %g under contention, want at least %g", h.GetSampleSum(), want)
+	}
+	if h.GetSampleSum() > 10 * gathers * held.Seconds() {
+		t.Errorf("collect_lock_wait_seconds sums to %g, want about %g", h.GetSampleSum(), (gathers - 1) * held.Seconds())
+	}
+}
+
+func TestCoalescedScrapes(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, CacheTTL: time.Minute})
+	const scrapes = 10
+	errs := make(chan error, scrapes)
+	for i := 0; i < scrapes; i++ {
+		go func() { errs <- e.Scrape() }()
+	}
+	waitFor(t, "every scrape to wait for the one in flight", func() bool {
+		return testutil.ToFloat64(e.coalescedScrapes) == scrapes - 1
+	})
+	close(release)
+	for i := 0; i < scrapes; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Scrape: %s", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%d concurrent scrapes fetched %d times, want once", scrapes, n)
+	}
+}
+
+func TestCanceledWaiter(t *testing.T) {
+	fetched := make(chan struct{}, 2)
+	release, canceled := make(chan struct{}), make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		select {
+		case <-release:
+			agentHandler(pluginsJSON)(w, r)
+		case <-r.Context().Done():
+			close(canceled)
+		}
+	}))
+	defer agent.Close()
+	defer close(release)
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error, 1)
+	go func() { gaveUp <- e.update(ctx, false) }()
+	<-fetched
+	stayed := make(chan error, 1)
+	go func() { stayed <- e.Scrape() }()
+	waitFor(t, "the second scrape to wait", func() bool { return testutil.ToFloat64(e.coalescedScrapes) == 1 })
+
+	// Another caller still waits, so the fetch goes on.
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Errorf("canceled update returned %v, want %v", err, context.Canceled)
+	}
+	release <- struct{}{}
+	if err := <-stayed; err != nil {
+		t.Errorf("Scrape after the other caller gave up: %s", err)
+	}
+	select {
+	case <-canceled:
+		t.Error("fetch canceled although a caller was waiting for it")
+	default:
+	}
+
+	// Alone, the caller giving up cancels the fetch, and the scrape isn't applied.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { gaveUp <- e.update(ctx, false) }()
+	<-fetched
+	cancel()
+	<-gaveUp
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fetch not canceled after its only caller gave up")
+	}
+	if errors := testutil.ToFloat64(e.totalErrors); errors != 0 {
+		t.Errorf("scrape_errors_total %g after a canceled scrape, want 0", errors)
+	}
+}
+
+func TestCallerAfterCanceledScrape(t *testing.T) {
+	var fetches int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			// Still busy when the only caller gives up.
+			<-r.Context().Done()
+			return
+		}
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error, 1)
+	go func() { gaveUp <- e.update(ctx, false) }()
+	waitFor(t, "the first fetch", func() bool { return atomic.LoadInt32(&fetches) == 1 })
+	cancel()
+	<-gaveUp
+
+	// Right after, while the canceled scrape may still be winding down: the
+	// new caller didn't cancel anything and must get a scrape of its own.
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("Scrape after the only waiter gave up: %s", err)
+	}
+	if up := testutil.ToFloat64(e.up); up != 1 {
+		t.Errorf("up %g, want 1", up)
+	}
+}
+
+func TestBufferQueuedChunks(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_new","type":"s3","output_plugin":true,"buffer_queue_length":2,"buffer_queued_chunks":5,"retry_count":0},
+		{"plugin_id":"out_old","type":"s3","output_plugin":true,"buffer_queue_length":2,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queued_chunks"}})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_queued_chunks{pluginId="out_new",pluginType="s3",worker=""}`: 5,
+	})
+	if series := seriesOf(got, "fluentd_buffer_queued_chunks"); len(series) != 1 {
+		t.Errorf("got %v, want none for the agent not reporting it", series)
+	}
+}
+
+func TestEmptyNamespace(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e, err := NewExporter(ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+		`last_scrape_error{}`: 0,
+	})
+	for series := range got {
+		if strings.HasPrefix(series, "fluentd_") || strings.HasPrefix(series, "_") {
+			t.Errorf("got %s without a namespace", series)
+		}
+	}
+}
+
+func TestQueuedSizeGrowth(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"buffer_queued_size_growth_bytes_per_second"}})
+	start := time.Now()
+	plugin := func(size float64, at time.Duration) Plugin {
+		return Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true, BufTotalQueuedSize: float(size), ScrapedAt: start.Add(at)}
+	}
+	growth := e.pluginMetrics["buffer_queued_size_growth_bytes_per_second"]
+	const series = `fluentd_buffer_queued_size_growth_bytes_per_second{pluginId="out_s3",pluginType="s3",worker=""}`
+
+	applyPlugins(e, plugin(1000, 0))
+	if _, ok := collect(t, growth)[series]; ok {
+		t.Error("got a growth rate after a single scrape")
+	}
+
+	// Filling.
+	applyPlugins(e, plugin(3000, 10 * time.Second))
+	expectSamples(t, collect(t, growth), map[string]float64{series: 200})
+
+	// Draining.
+	applyPlugins(e, plugin(500, 15 * time.Second))
+	expectSamples(t, collect(t, growth), map[string]float64{series: -500})
+}
+
+func TestPluginTypeChanges(t *testing.T) {
+	body := pluginsJSON
+	var mu sync.Mutex
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		agentHandler(body)(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	e.Scrape()
+	e.Scrape()
+	if series := seriesOf(collect(t, e.typeChanges), "fluentd_plugin_type_changes_total"); len(series) != 0 {
+		t.Errorf("got %v without a type change", series)
+	}
+
+	mu.Lock()
+	body = strings.Replace(pluginsJSON, `"type":"s3"`, `"type":"s3_v2"`, 1)
+	mu.Unlock()
+	e.Scrape()
+	expectSamples(t, collect(t, e.typeChanges), map[string]float64{
+		`fluentd_plugin_type_changes_total{pluginId="out_s3",worker=""}`: 1,
+	})
+}
+
+func TestExportedSeries(t *testing.T) {
+	plugin := func(id string) Plugin {
+		return Plugin{PluginId: id, PluginType: "s3", OutputPlugin: true, BufQueueLength: float(1), BufTotalQueuedSize: float(100)}
+	}
+	// The cache keeps collect from scraping over the applied plugins.
+	opts := ExporterOpts{Metrics: []string{"buffer_queue_length", "buffer_total_queued_size", "retry_count"}, CacheTTL: time.Hour}
+
+	one := newTestExporter(t, opts)
+	applyPlugins(one, plugin("out_a"))
+	one.lastScrape = time.Now()
+	gotOne := collect(t, one)
+	if n := gotOne[`fluentd_exported_series{}`]; int(n) != len(gotOne) {
+		t.Errorf("exported_series = %g, collected %d series", n, len(gotOne))
+	}
+
+	two := newTestExporter(t, opts)
+	applyPlugins(two, plugin("out_a"), plugin("out_b"))
+	two.lastScrape = time.Now()
+	gotTwo := collect(t, two)
+	perPlugin := 0
+	for series := range gotTwo {
+		if labelValue(series, "pluginId") == "out_b" {
+			perPlugin++
+		}
+	}
+	if perPlugin == 0 {
+		t.Fatal("got no series of out_b")
+	}
+	if diff := gotTwo[`fluentd_exported_series{}`] - gotOne[`fluentd_exported_series{}`]; int(diff) != perPlugin {
+		t.Errorf("exported_series grew by %g for a plugin with %d series", diff, perPlugin)
+	}
+}
+
+func TestTimekeySpread(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_hourly","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"buffer_newest_timekey":1559397600,"buffer_oldest_timekey":1559390400},
+		{"plugin_id":"out_lagging","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"buffer_newest_timekey":1559397600,"buffer_oldest_timekey":1559376000},
+		{"plugin_id":"out_current","type":"gcs","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"buffer_newest_timekey":1559397600,"buffer_oldest_timekey":1559397600},
+		{"plugin_id":"out_untimed","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	got := collect(t, e)
+	want := `fluentd_max_buffer_timekey_spread_seconds{pluginId="out_lagging",pluginType="s3",worker=""}`
+	if series := seriesOf(got, "fluentd_max_buffer_timekey_spread_seconds"); len(series) != 1 || series[0] != want {
+		t.Fatalf("got %v, want %s", series, want)
+	}
+	expectSamples(t, got, map[string]float64{want: 21600})
+}
+
+var descNameHelp = regexp.MustCompile(`fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*")`)
+
+func TestHelpIsNotTheName(t *testing.T) {
+	var metrics []string
+	for name := range pluginMetricHelp {
+		metrics = append(metrics, name)
+	}
+	e := newTestExporter(t, ExporterOpts{Metrics: metrics, ExposeConfig: true, AllPlugins: true})
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(ch)
+		close(ch)
+	}()
+
+	n := 0
+	for desc := range ch {
+		m := descNameHelp.FindStringSubmatch(desc.String())
+		if m == nil {
+			t.Fatalf("unexpected Desc format %s", desc)
+		}
+		name, _ := strconv.Unquote(m[1])
+		help, _ := strconv.Unquote(m[2])
+		short := strings.TrimPrefix(name, "fluentd_")
+		if help == "" || help == name || help == short {
+			t.Errorf("%s has help %q", name, help)
+		}
+		n++
+	}
+	if n < len(metrics) {
+		t.Errorf("described %d metrics, fewer than the %d plugin metrics", n, len(metrics))
+	}
+
+	// The metrics of ExporterOpts.TypeInName are created while scraping.
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+	typed := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: metrics, TypeInName: true})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(typed)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if help := mf.GetHelp(); help == "" || help == mf.GetName() || help == strings.TrimPrefix(mf.GetName(), "fluentd_") {
+			t.Errorf("%s has help %q", mf.GetName(), help)
+		}
+	}
+}
+
+func TestNamespaceFromIDPrefix(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"app1_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0},
+		{"plugin_id":"app2_es_main","type":"elasticsearch","output_plugin":true,"buffer_queue_length":2,"retry_count":0},
+		{"plugin_id":"stdout","type":"stdout","output_plugin":true,"buffer_queue_length":3,"retry_count":0},
+		{"plugin_id":"_hidden","type":"null","output_plugin":true,"buffer_queue_length":4,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, NamespaceFromIDPrefix: true})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_buffer_queue_length{logical_namespace="app1",pluginId="app1_s3",pluginType="s3",worker=""}`:                 1,
+		`fluentd_buffer_queue_length{logical_namespace="app2",pluginId="app2_es_main",pluginType="elasticsearch",worker=""}`: 2,
+		// Without a prefix before an underscore the label is empty.
+		`fluentd_buffer_queue_length{logical_namespace="",pluginId="stdout",pluginType="stdout",worker=""}`: 3,
+		`fluentd_buffer_queue_length{logical_namespace="",pluginId="_hidden",pluginType="null",worker=""}`:  4,
+	})
+}
+
+func TestRetryCountAll(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_a","type":"s3","output_plugin":true,"retry_count":3},
+		{"plugin_id":"out_b","type":"s3","output_plugin":true,"retry_count":4},
+		{"plugin_id":"out_c","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{`fluentd_retry_count_all{}`: 7})
+}
+
+func TestLockTimeout(t *testing.T) {
+	var slow int32
+	release := make(chan struct{})
+	plugins := agentHandler(pluginsJSON)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		plugins(w, r)
+	}))
+	defer agent.Close()
+	defer close(release)
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, LockTimeout: 50 * time.Millisecond})
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("first scrape: %s", err)
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	if err := e.Scrape(); err != ErrLockTimeout {
+		t.Fatalf("scrape of a stuck agent returned %v, want ErrLockTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scrape gave up after %s, want about the 50ms lock timeout", elapsed)
+	}
+
+	// Only the caller that timed out sees the error, on the metrics of the
+	// last scrape.
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_last_scrape_error{}`:                                              1,
+		`fluentd_lock_timeouts_total{}`:                                            2,
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+	if got := testutil.ToFloat64(e.error); got != 0 {
+		t.Errorf("last_scrape_error of the exporter = %g, want 0", got)
+	}
+}
+
+func TestStagingNotFlushing(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{})
+	plugins := func(stuckQueue, flushingQueue float64) []Plugin {
+		return []Plugin{
+			{PluginId: "out_stuck", PluginType: "s3", OutputPlugin: true, BufStageLength: float(2), BufQueueLength: float(stuckQueue)},
+			{PluginId: "out_flushing", PluginType: "s3", OutputPlugin: true, BufStageLength: float(2), BufQueueLength: float(flushingQueue)},
+			{PluginId: "out_unbuffered", PluginType: "stdout", OutputPlugin: true},
+		}
+	}
+	expectStaging := func(want float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(e.stagingPlugins); got != want {
+			t.Errorf("plugins_staging_not_flushing = %g, want %g", got, want)
+		}
+	}
+
+	// One scrape isn't enough to tell.
+	applyPlugins(e, plugins(0, 0)...)
+	expectStaging(0)
+
+	applyPlugins(e, plugins(0, 1)...)
+	expectStaging(1)
+
+	// out_flushing has staged without queueing once since it last queued.
+	applyPlugins(e, plugins(0, 0)...)
+	expectStaging(1)
+
+	applyPlugins(e, plugins(0, 0)...)
+	expectStaging(2)
+
+	// Queueing a chunk clears it.
+	applyPlugins(e, plugins(1, 0)...)
+	expectStaging(1)
+}
+
+func TestSecondsSinceEmpty(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"plugin_seconds_since_empty"}})
+	start := time.Now()
+	series := `fluentd_plugin_seconds_since_empty{pluginId="out_s3",pluginType="s3",worker=""}`
+	for _, scrape := range []struct {
+		at    time.Duration
+		queue float64
+		want  float64
+	}{
+		// Counted from the first scrape when it isn't empty then.
+		{0, 2, 0},
+		{10 * time.Second, 3, 10},
+		{20 * time.Second, 0, 0},
+		{30 * time.Second, 1, 10},
+		{45 * time.Second, 4, 25},
+		{50 * time.Second, 0, 0},
+	} {
+		applyPlugins(e, Plugin{PluginId: "out_s3", PluginType: "s3", OutputPlugin: true, BufQueueLength: float(scrape.queue), ScrapedAt: start.Add(scrape.at)})
+		if got := collect(t, e.pluginMetrics["plugin_seconds_since_empty"])[series]; got != scrape.want {
+			t.Errorf("after %s with a queue of %g: got %g, want %g", scrape.at, scrape.queue, got, scrape.want)
+		}
+	}
+}
+
+func TestEmitWriteGap(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"emit_count":1500,"write_count":1200},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0,"emit_count":1500},
+		{"plugin_id":"in_forward","type":"forward","output_plugin":false}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"emit_write_gap"}})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_emit_write_gap{pluginId="out_s3",pluginType="s3",worker=""}`: 300,
+	})
+	// Without write_count there's nothing to subtract.
+	if series := seriesOf(got, "fluentd_emit_write_gap"); len(series) != 1 {
+		t.Errorf("got %v, want out_s3 only", series)
+	}
+}
+
+func TestNeverFlushed(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_stuck","type":"s3","output_plugin":true,"buffer_queue_length":4,"retry_count":3,"emit_count":1500,"write_count":0},
+		{"plugin_id":"out_fresh","type":"s3","output_plugin":true,"buffer_queue_length":0,"retry_count":0,"emit_count":0,"write_count":0},
+		{"plugin_id":"out_flushed","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0,"emit_count":1500,"write_count":12},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0,"emit_count":1500}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{`fluentd_plugins_never_flushed{}`: 1})
+}
@@ -0,0 +1,375 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// largePluginsJSON returns a /api/plugins.json response with n buffered
+// output plugins.
+func largePluginsJSON(n int) string {
+	var b strings.Builder
+	b.WriteString(`{"plugins":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"plugin_id":"out_%d","plugin_category":"output","type":"s3","output_plugin":true,"buffer_queue_length":%d,"buffer_total_queued_size":%d,"retry_count":0,"config":{"@type":"s3","path":"logs/%d/"}}`, i, i % 10, i * 1024, i)
+	}
+	b.WriteString(`]}`)
+	return b.String()
+}
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestFetchGzip(t *testing.T) {
+	body := gzipped(pluginsJSON)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Compressed although the client didn't ask for it.
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	got, err := e.fetch(context.Background(), agent.URL)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(got.Plugins) != 3 || got.Plugins[0].PluginId != "out_s3" {
+		t.Errorf("got plugins %+v", got.Plugins)
+	}
+}
+
+// BenchmarkFetchStream measures fetch, which decodes the response as it
+// reads it. Compare its B/op with BenchmarkFetchReadAll.
+func BenchmarkFetchStream(b *testing.B) {
+	agent := newAgent(largePluginsJSON(5000))
+	defer agent.Close()
+	e := newTestExporter(b, ExporterOpts{Endpoints: []string{agent.URL}})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.fetch(context.Background(), agent.URL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFetchReadAll measures reading the whole response before decoding
+// it, as the exporter used to.
+func BenchmarkFetchReadAll(b *testing.B) {
+	agent := newAgent(largePluginsJSON(5000))
+	defer agent.Close()
+	client := &http.Client{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := client.Get(agent.URL + "/api/plugins.json")
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var body PluginsBody
+		if err := json.Unmarshal(data, &body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStrictDecode(t *testing.T) {
+	agent := newAgent(`{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"retry_count":0,"flush_mode":"interval"}]}`)
+	defer agent.Close()
+
+	lenient := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	if _, err := lenient.fetch(agent.URL); err != nil {
+		t.Errorf("lenient fetch failed on an unknown field: %s", err)
+	}
+
+	strict := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, StrictDecode: true})
+	_, err := strict.fetch(agent.URL)
+	if err == nil || !strings.Contains(err.Error(), "flush_mode") {
+		t.Errorf("strict fetch returned %v, want an error naming flush_mode", err)
+	}
+	expectSamples(t, collect(t, strict), map[string]float64{
+		`fluentd_scrape_error_causes_total{cause="strict_decode"}`: 1,
+		`fluentd_last_scrape_error{}`:                              1,
+	})
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	// Flushing mid-response makes it chunked, without a Content-Length.
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := largePluginsJSON(100)
+		fmt.Fprint(w, body[:len(body) / 2])
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, body[len(body) / 2:])
+	}))
+	defer agent.Close()
+
+	limited := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, MaxResponseBytes: 1024})
+	_, err := limited.fetch(agent.URL)
+	if err == nil || !strings.Contains(err.Error(), "exceeds 1024 bytes") {
+		t.Errorf("fetch returned %v, want the limit to trip", err)
+	}
+	expectSamples(t, collect(t, limited), map[string]float64{
+		`fluentd_scrape_error_causes_total{cause="decode"}`: 1,
+	})
+
+	unlimited := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	if _, err := unlimited.fetch(agent.URL); err != nil {
+		t.Errorf("chunked response without a limit failed: %s", err)
+	}
+}
+
+func TestDialAddress(t *testing.T) {
+	hosts := make(chan string, 1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	// The endpoint's host doesn't resolve; only the dial address reaches the agent.
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints:   []string{"http://fluentd.invalid:24220"},
+		DialAddress: agent.Listener.Addr().String(),
+	})
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("scrape through the dial address failed: %s", err)
+	}
+	if host := <-hosts; host != "fluentd.invalid:24220" {
+		t.Errorf("agent got Host %q, want the endpoint's fluentd.invalid:24220", host)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	target := newAgent(pluginsJSON)
+	defer target.Close()
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL + r.URL.Path, http.StatusFound)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	if err := e.Scrape(); err == nil || !strings.Contains(err.Error(), "302") {
+		t.Errorf("scrape of a redirecting agent returned %v, want an error naming the 302", err)
+	}
+
+	following := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, FollowRedirects: true})
+	if err := following.Scrape(); err != nil {
+		t.Errorf("scrape following the redirect failed: %s", err)
+	}
+	expectSamples(t, collect(t, following.pluginMetrics["buffer_queue_length"]), map[string]float64{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+}
+
+func TestJSONP(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "callback(%s);", pluginsJSON)
+	}))
+	defer agent.Close()
+
+	strict := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	if err := strict.Scrape(); err == nil {
+		t.Error("scrape of a JSONP response succeeded without AllowJSONP")
+	}
+
+	lenient := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, AllowJSONP: true})
+	if err := lenient.Scrape(); err != nil {
+		t.Fatalf("scrape of a JSONP response failed with AllowJSONP: %s", err)
+	}
+	expectSamples(t, collect(t, lenient.pluginMetrics["buffer_queue_length"]), map[string]float64{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+	})
+}
+
+func TestBareArray(t *testing.T) {
+	object := newAgent(pluginsJSON)
+	defer object.Close()
+	plugins := strings.TrimSuffix(strings.TrimPrefix(pluginsJSON, `{"plugins":`), `}`)
+	array := newAgent("\n  " + plugins)
+	defer array.Close()
+
+	for _, strict := range []bool{false, true} {
+		opts := ExporterOpts{Metrics: []string{"buffer_queue_length"}, StrictDecode: strict}
+		opts.Endpoints = []string{object.URL}
+		want := collect(t, newTestExporter(t, opts))
+		opts.Endpoints = []string{array.URL}
+		got := collect(t, newTestExporter(t, opts))
+		expectSamples(t, got, map[string]float64{
+			`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`: 3,
+		})
+		for _, series := range []string{
+			`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""}`,
+			`fluentd_last_scrape_error{}`,
+			`fluentd_plugins_by_category{category="output"}`,
+		} {
+			if got[series] != want[series] {
+				t.Errorf("strict %t: %s = %g for a bare array, want %g as for an object", strict, series, got[series], want[series])
+			}
+		}
+	}
+}
+
+func TestResponseAge(t *testing.T) {
+	plugins := agentHandler(pluginsJSON)
+	cached := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Age", "42")
+		plugins(w, r)
+	}))
+	defer cached.Close()
+	fresh := newAgent(pluginsJSON)
+	defer fresh.Close()
+
+	expectSamples(t, collect(t, newTestExporter(t, ExporterOpts{Endpoints: []string{cached.URL}})), map[string]float64{
+		`fluentd_response_age_seconds{worker=""}`: 42,
+	})
+	expectSamples(t, collect(t, newTestExporter(t, ExporterOpts{Endpoints: []string{fresh.URL}})), map[string]float64{
+		`fluentd_response_age_seconds{worker=""}`: 0,
+	})
+}
+
+func TestAgentDataAge(t *testing.T) {
+	computed := time.Now().Add(-30 * time.Second)
+	agent := newAgent(fmt.Sprintf(`{"timestamp":%q,"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"retry_count":0}
+	]}`, computed.Format(time.RFC3339Nano)))
+	defer agent.Close()
+	fresh := newAgent(pluginsJSON)
+	defer fresh.Close()
+
+	got := collect(t, newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, StrictDecode: true}))
+	if age, ok := got[`fluentd_agent_data_age_seconds{worker=""}`]; !ok || age < 30 || age > 35 {
+		t.Errorf("agent_data_age_seconds = %g (%t), want about 30", age, ok)
+	}
+	if series := seriesOf(collect(t, newTestExporter(t, ExporterOpts{Endpoints: []string{fresh.URL}})), "fluentd_agent_data_age_seconds"); len(series) != 0 {
+		t.Errorf("got %v for a response without a timestamp", series)
+	}
+
+	e := newTestExporter(t, ExporterOpts{})
+	e.setDataAge("", json.RawMessage(`1500000000.5`), time.Unix(1500000012, 0))
+	if age := testutil.ToFloat64(e.dataAge.WithLabelValues("")); age != 11.5 {
+		t.Errorf("agent_data_age_seconds = %g for an epoch timestamp, want 11.5", age)
+	}
+}
+
+func TestDecodeDuration(t *testing.T) {
+	agent := newAgent(largePluginsJSON(2000))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	d, ok := collect(t, e)[`fluentd_json_decode_duration_seconds{worker=""}`]
+	if !ok || d <= 0 {
+		t.Errorf("json_decode_duration_seconds = %g (%t) for 2000 plugins, want a positive duration", d, ok)
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer agent.Close()
+	defer close(release)
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Timeout: 50 * time.Millisecond})
+	if err := e.Scrape(); err == nil {
+		t.Fatal("scrape of a hanging agent succeeded")
+	}
+	if timeouts, causes := testutil.ToFloat64(e.timeouts), testutil.ToFloat64(e.errorCauses.WithLabelValues("timeout")); timeouts != 1 || causes != 1 {
+		t.Errorf("scrape_timeouts_total %g, scrape_error_causes_total{cause=\"timeout\"} %g, want 1", timeouts, causes)
+	}
+
+	// Other errors aren't timeouts.
+	down := newTestExporter(t, ExporterOpts{Endpoints: []string{downURL()}})
+	down.Scrape()
+	if timeouts := testutil.ToFloat64(down.timeouts); timeouts != 0 {
+		t.Errorf("scrape_timeouts_total %g for an unreachable agent, want 0", timeouts)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	queries := make(chan string, 2)
+	// Like agents without tag filtering, this one ignores the query.
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		agentHandler(pluginsJSON)(w, r)
+	}))
+	defer agent.Close()
+
+	filtered := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, TagFilter: "app.access&x"})
+	if err := filtered.Scrape(); err != nil {
+		t.Fatalf("scrape with a tag filter: %s", err)
+	}
+	if q := <-queries; q != "tag=app.access%26x" {
+		t.Errorf("query %q, want tag=app.access%%26x", q)
+	}
+
+	unfiltered := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	if err := unfiltered.Scrape(); err != nil {
+		t.Fatalf("scrape without a tag filter: %s", err)
+	}
+	if q := <-queries; q != "" {
+		t.Errorf("query %q without a tag filter", q)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html><body>Please log in</body></html>")
+	}))
+	defer portal.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{portal.URL}})
+	err := e.Scrape()
+	if err == nil || !strings.Contains(err.Error(), `Content-Type "text/html; charset=utf-8", not JSON`) {
+		t.Errorf("scrape of an HTML page returned %v, want a Content-Type error", err)
+	}
+	if got := testutil.ToFloat64(e.errorCauses.WithLabelValues("content_type")); got != 1 {
+		t.Errorf("fluentd_scrape_error_causes_total{cause=\"content_type\"} = %g, want 1", got)
+	}
+}
+
+func TestJSONContentType(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"":                                true, // not set, decoding decides
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"text/plain":                      true,
+		"application/vnd.fluentd+json":    true,
+		"text/html":                       false,
+		"application/xml":                 false,
+		"not a media type;;":              false,
+	} {
+		if got := jsonContentType(ct); got != want {
+			t.Errorf("jsonContentType(%q) = %t, want %t", ct, got, want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package collector
+
+// errorRatioWindow is the number of recent scrapes scrape_error_ratio covers.
+const errorRatioWindow = 60
+
+// outcomeRing records whether each of the last errorRatioWindow scrapes
+// failed.
+type outcomeRing struct {
+	failed [errorRatioWindow]bool
+	next   int
+	n      int
+	errors int
+}
+
+// add records the outcome of a scrape, dropping the oldest one once the
+// window is full.
+func (r *outcomeRing) add(failed bool) {
+	if r.n == len(r.failed) {
+		if r.failed[r.next] {
+			r.errors--
+		}
+	} else {
+		r.n++
+	}
+	r.failed[r.next] = failed
+	if failed {
+		r.errors++
+	}
+	r.next = (r.next + 1) % len(r.failed)
+}
+
+// ratio returns the share of failed scrapes in the window, 0 before the
+// first scrape.
+func (r *outcomeRing) ratio() float64 {
+	if r.n == 0 {
+		return 0
+	}
+	return float64(r.errors) / float64(r.n)
+}
@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOutcomeRing(t *testing.T) {
+	var r outcomeRing
+	if got := r.ratio(); got != 0 {
+		t.Errorf("ratio before any scrape = %g, want 0", got)
+	}
+
+	r.add(true)
+	r.add(false)
+	r.add(false)
+	r.add(true)
+	if got := r.ratio(); got != 0.5 {
+		t.Errorf("ratio after 2 of 4 failed = %g, want 0.5", got)
+	}
+
+	// Once the window is full, the oldest outcomes drop out.
+	for i := 0; i < errorRatioWindow; i++ {
+		r.add(false)
+	}
+	if got := r.ratio(); got != 0 {
+		t.Errorf("ratio after a window of successes = %g, want 0", got)
+	}
+	r.add(true)
+	if got, want := r.ratio(), 1.0 / errorRatioWindow; got != want {
+		t.Errorf("ratio after 1 failure in a full window = %g, want %g", got, want)
+	}
+}
+
+func TestScrapeErrorRatio(t *testing.T) {
+	var failing int32
+	ok := agentHandler(pluginsJSON)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		ok(w, r)
+	}))
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	for _, fail := range []bool{false, true, false, true, true} {
+		if fail {
+			atomic.StoreInt32(&failing, 1)
+		} else {
+			atomic.StoreInt32(&failing, 0)
+		}
+		e.Scrape()
+	}
+	if got := testutil.ToFloat64(e.errorRatio); got != 0.6 {
+		t.Errorf("scrape_error_ratio after 3 of 5 failed = %g, want 0.6", got)
+	}
+}
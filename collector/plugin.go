@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PluginsBody is the response of the monitor agent's /api/plugins.json.
+type PluginsBody struct {
+	Plugins []Plugin `json:"plugins"`
+
+	// Timestamp is when the stats were computed, for agents reporting it.
+	// See parseAgentTime.
+	Timestamp json.RawMessage `json:"timestamp"`
+
+	Age            time.Duration `json:"-"` // from the Age response header, 0 without one
+	DecodeDuration time.Duration `json:"-"` // time spent reading and decoding the body
+}
+
+// arrayTarget lets fetchJSON decode the bare plugin arrays some Fluentd forks
+// return into Plugins.
+func (b *PluginsBody) arrayTarget() interface{} {
+	return &b.Plugins
+}
+
+// Plugin is one plugin as reported by the monitor agent.
+type Plugin struct {
+	PluginId           string                 `json:"plugin_id"`
+	PluginType         string                 `json:"type"`
+	PluginCategory     string                 `json:"plugin_category"`
+	OutputPlugin       bool                   `json:"output_plugin"`
+	BufQueueLength     *float64               `json:"buffer_queue_length"`
+	BufStageLength     *float64               `json:"buffer_stage_length"`
+	BufTotalQueuedSize *float64               `json:"buffer_total_queued_size"`
+	BufQueuedChunks    *float64               `json:"buffer_queued_chunks"`
+	RetryCount         float64                `json:"retry_count"`
+	EmitCount          *float64               `json:"emit_count"`
+	WriteCount         *float64               `json:"write_count"`
+	NewestTimekey      *float64               `json:"buffer_newest_timekey"`
+	OldestTimekey      *float64               `json:"buffer_oldest_timekey"`
+	Retry              *PluginRetry           `json:"retry"`
+	Config             map[string]interface{} `json:"config"`
+
+	Worker    string    `json:"-"` // set by the Exporter, see Exporter.worker
+	ScrapedAt time.Time `json:"-"` // set by the Exporter when the plugin was fetched
+}
+
+// Buffered reports whether the plugin reports buffer metrics, i.e. is a
+// buffered output.
+func (p Plugin) Buffered() bool {
+	return p.BufQueueLength != nil || p.BufTotalQueuedSize != nil
+}
+
+// QueueLength returns buffer_queue_length, 0 when not reported.
+func (p Plugin) QueueLength() float64 {
+	return valueOrZero(p.BufQueueLength)
+}
+
+// TotalQueuedSize returns buffer_total_queued_size, 0 when not reported.
+func (p Plugin) TotalQueuedSize() float64 {
+	return valueOrZero(p.BufTotalQueuedSize)
+}
+
+// outputMode classifies an output plugin as buffered or non_buffered by
+// whether it reports buffer fields. The agent reports nothing telling
+// synchronous and asynchronous flushing apart.
+func (p Plugin) outputMode() string {
+	if !p.Buffered() {
+		return "non_buffered"
+	}
+	return "buffered"
+}
+
+// anonymousID matches the ids Fluentd generates for plugins without @id.
+var anonymousID = regexp.MustCompile(`^object:[0-9a-f]+$`)
+
+// explicitID reports whether the plugin's id was set with @id rather than
+// generated, which changes whenever Fluentd restarts.
+func (p Plugin) explicitID() bool {
+	return !anonymousID.MatchString(p.PluginId)
+}
+
+// neverFlushed reports whether the plugin emitted records but has not written
+// a single chunk, e.g. because every flush failed since the worker started.
+func (p Plugin) neverFlushed() bool {
+	return p.EmitCount != nil && *p.EmitCount > 0 && p.WriteCount != nil && *p.WriteCount == 0
+}
+
+// secondary reports whether the plugin is the <secondary> output of another,
+// which Fluentd setups conventionally mark with a ":secondary" id suffix.
+func (p Plugin) secondary() bool {
+	return strings.HasSuffix(p.PluginId, ":secondary")
+}
+
+// timekeySpread returns buffer_newest_timekey - buffer_oldest_timekey, how
+// many seconds of time slices the buffer holds, and whether the plugin
+// reports both.
+func (p Plugin) timekeySpread() (float64, bool) {
+	if p.NewestTimekey == nil || p.OldestTimekey == nil {
+		return 0, false
+	}
+	return *p.NewestTimekey - *p.OldestTimekey, true
+}
+
+func valueOrZero(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// key identifies a plugin across scrapes.
+func (p Plugin) key() string {
+	return p.Worker + "/" + p.PluginId
+}
+
+// presentFields returns the optional fields, by their JSON name, that at least
+// one of plugins reported.
+func presentFields(plugins []Plugin) []string {
+	present := map[string]bool{}
+	for _, p := range plugins {
+		present["buffer_stage_length"] = present["buffer_stage_length"] || p.BufStageLength != nil
+		present["buffer_queued_chunks"] = present["buffer_queued_chunks"] || p.BufQueuedChunks != nil
+		present["buffer_newest_timekey"] = present["buffer_newest_timekey"] || p.NewestTimekey != nil
+		present["emit_count"] = present["emit_count"] || p.EmitCount != nil
+		present["write_count"] = present["write_count"] || p.WriteCount != nil
+		present["retry"] = present["retry"] || p.Retry != nil
+		present["config"] = present["config"] || p.Config != nil
+		present["plugin_category"] = present["plugin_category"] || p.PluginCategory != ""
+	}
+
+	var fields []string
+	for field, ok := range present {
+		if ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPresentFields(t *testing.T) {
+	var body PluginsBody
+	err := json.Unmarshal([]byte(`{"plugins":[
+		{"plugin_id":"out_s3","plugin_category":"output","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_stage_length":2,"retry_count":1,"emit_count":10,"retry":{"steps":1,"next_time":1559392215}},
+		{"plugin_id":"out_stdout","plugin_category":"output","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := presentFields(body.Plugins)
+	want := []string{"buffer_stage_length", "emit_count", "plugin_category", "retry"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("presentFields = %v, want %v", got, want)
+	}
+}
+
+func TestOutputPluginMode(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0},
+		{"plugin_id":"out_file","type":"file","output_plugin":true,"buffer_total_queued_size":0,"retry_count":0},
+		{"plugin_id":"out_stdout","type":"stdout","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_output_plugin_mode{mode="buffered",pluginId="out_s3",pluginType="s3",worker=""}`:             1,
+		`fluentd_output_plugin_mode{mode="buffered",pluginId="out_file",pluginType="file",worker=""}`:         1,
+		`fluentd_output_plugin_mode{mode="non_buffered",pluginId="out_stdout",pluginType="stdout",worker=""}`: 1,
+	})
+	if series := seriesOf(got, "fluentd_output_plugin_mode"); len(series) != 3 {
+		t.Errorf("got %v, want one mode per plugin", series)
+	}
+}
+
+func TestOutputPluginSecondary(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":1,"retry_count":0},
+		{"plugin_id":"out_s3:secondary","type":"file","output_plugin":true,"buffer_queue_length":0,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{
+		`fluentd_output_plugin_secondary{pluginId="out_s3",pluginType="s3",worker=""}`:             0,
+		`fluentd_output_plugin_secondary{pluginId="out_s3:secondary",pluginType="file",worker=""}`: 1,
+	})
+}
+
+func TestPluginsWithoutExplicitID(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"retry_count":0},
+		{"plugin_id":"object:3fe","type":"stdout","output_plugin":true,"retry_count":0},
+		{"plugin_id":"object:2ab4c8","type":"file","output_plugin":true,"retry_count":0},
+		{"plugin_id":"object_store","type":"s3","output_plugin":true,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	expectSamples(t, collect(t, e), map[string]float64{`fluentd_plugins_without_explicit_id{}`: 2})
+}
+
+func TestPluginIsOutput(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"in_forward","type":"forward","output_plugin":false},
+		{"plugin_id":"filter_grep","type":"grep","output_plugin":false},
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	all := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, AllPlugins: true})
+	got := collect(t, all)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_plugin_is_output{pluginId="in_forward",pluginType="forward",worker=""}`: 0,
+		`fluentd_plugin_is_output{pluginId="filter_grep",pluginType="grep",worker=""}`:   0,
+		`fluentd_plugin_is_output{pluginId="out_s3",pluginType="s3",worker=""}`:          1,
+	})
+	// Every other metric is still for output plugins only.
+	for _, name := range []string{"fluentd_output_plugin_mode", "fluentd_retry_count", "fluentd_buffer_queue_length"} {
+		if series := seriesOf(got, name); len(series) != 1 || labelValue(series[0], "pluginId") != "out_s3" {
+			t.Errorf("got %s %v, want out_s3 only", name, series)
+		}
+	}
+
+	outputs := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}})
+	want := collect(t, outputs)
+	if series := seriesOf(want, "fluentd_plugin_is_output"); len(series) != 0 {
+		t.Errorf("got %v without AllPlugins, where every plugin is an output", series)
+	}
+	for _, name := range []string{"fluentd_distinct_plugin_types{}", "fluentd_plugins_without_explicit_id{}", "fluentd_idle_plugins{}", "fluentd_buffer_total_queued_size_all{}"} {
+		if got[name] != want[name] {
+			t.Errorf("got %s %g with AllPlugins, want %g as without", name, got[name], want[name])
+		}
+	}
+}
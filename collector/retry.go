@@ -0,0 +1,54 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// PluginRetry is the retry state the monitor agent reports for a retrying
+// output plugin.
+type PluginRetry struct {
+	Start    json.RawMessage `json:"start"` // see parseAgentTime
+	Steps    float64         `json:"steps"`
+	NextTime json.RawMessage `json:"next_time"` // see parseAgentTime
+}
+
+// agentTimeLayouts are the string forms of times seen across Fluentd
+// versions: Ruby's Time#to_s and ISO 8601.
+var agentTimeLayouts = []string{
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339Nano,
+}
+
+// parseAgentTime parses a time reported by the agent, like retry.next_time,
+// which Fluentd versions serialize as a time string, a float epoch or an
+// integer epoch.
+func parseAgentTime(raw json.RawMessage) (time.Time, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		for _, layout := range agentTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		// Some versions quote the epoch.
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return epochTime(f), nil
+		}
+		return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+	}
+
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return epochTime(f), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %s", string(raw))
+}
+
+func epochTime(f float64) time.Time {
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac * 1e9))
+}
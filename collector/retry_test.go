@@ -0,0 +1,58 @@
+package collector
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseAgentTime(t *testing.T) {
+	want := time.Date(2019, 6, 1, 12, 30, 15, 0, time.UTC)
+	tests := []struct {
+		name string
+		raw  string
+		want time.Time
+		err  bool
+	}{
+		{name: "ruby string", raw: `"2019-06-01 21:30:15 +0900"`, want: want},
+		{name: "iso string", raw: `"2019-06-01T12:30:15Z"`, want: want},
+		{name: "iso string with fraction", raw: `"2019-06-01T12:30:15.25Z"`, want: want.Add(250 * time.Millisecond)},
+		{name: "float epoch", raw: `1559392215.5`, want: want.Add(500 * time.Millisecond)},
+		{name: "integer epoch", raw: `1559392215`, want: want},
+		{name: "quoted epoch", raw: `"1559392215"`, want: want},
+		{name: "unrecognized string", raw: `"tomorrow"`, err: true},
+		{name: "unrecognized value", raw: `{"sec":1559392215}`, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAgentTime(json.RawMessage(tt.raw))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: parseAgentTime(%s) = %s, want an error", tt.name, tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseAgentTime(%s): %s", tt.name, tt.raw, err)
+		} else if !got.Equal(tt.want) {
+			t.Errorf("%s: parseAgentTime(%s) = %s, want %s", tt.name, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRetryNextTime(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_a","type":"s3","output_plugin":true,"retry_count":1,"retry":{"steps":1,"next_time":1559392215}},
+		{"plugin_id":"out_b","type":"s3","output_plugin":true,"retry_count":1,"retry":{"steps":1,"next_time":"tomorrow"}}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"retry_next_time_seconds"}})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_retry_next_time_seconds{pluginId="out_a",pluginType="s3",worker=""}`: 1559392215,
+		`fluentd_retry_time_parse_errors_total{}`:                                     1,
+	})
+	if _, ok := got[`fluentd_retry_next_time_seconds{pluginId="out_b",pluginType="s3",worker=""}`]; ok {
+		t.Error("retry_next_time_seconds exposed for an unparsable next_time")
+	}
+}
@@ -0,0 +1,136 @@
+package collector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// tlsFiles holds the CA and client certificate files of ExporterOpts,
+// re-reading them when they change so renewed certificates are used without
+// a restart.
+type tlsFiles struct {
+	caFile, certFile, keyFile string
+
+	mu        sync.Mutex
+	caMtime   time.Time
+	pool      *x509.CertPool
+	certMtime time.Time
+	cert      *tls.Certificate
+}
+
+// config returns a tls.Config using the files. Client certificates are
+// re-read on handshakes after they changed; see Exporter.reloadCA for the CAs.
+func (f *tlsFiles) config(serverName string) (*tls.Config, error) {
+	c := &tls.Config{ServerName: serverName}
+	if f.certFile != "" {
+		if _, err := f.clientCert(); err != nil {
+			return nil, err
+		}
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return f.clientCert()
+		}
+	}
+	if f.caFile != "" {
+		pool, _, err := f.roots()
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
+
+func (f *tlsFiles) clientCert() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mtime, err := latestMtime(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if f.cert == nil || !mtime.Equal(f.certMtime) {
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		f.cert, f.certMtime = &cert, mtime
+	}
+	return f.cert, nil
+}
+
+// roots returns the CA pool and whether it was re-read since the last call.
+func (f *tlsFiles) roots() (*x509.CertPool, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mtime, err := latestMtime(f.caFile)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.pool != nil && mtime.Equal(f.caMtime) {
+		return f.pool, false, nil
+	}
+	pem, err := ioutil.ReadFile(f.caFile)
+	if err != nil {
+		return nil, false, err
+	}
+	// Add to the system pool rather than replacing it, so agents behind
+	// publicly trusted certificates keep validating.
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Warnf("Failed to load the system CAs, only trusting %s. %s", f.caFile, err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, false, fmt.Errorf("no certificates in %s", f.caFile)
+	}
+	f.pool, f.caMtime = pool, mtime
+	return pool, true, nil
+}
+
+// reloadCA switches the client to a transport trusting the current CA file
+// when it changed. tls.Config has no callback for the roots, so this is done
+// at the start of every scrape; scrapes never run concurrently.
+func (e *Exporter) reloadCA() {
+	if e.tlsFiles.caFile == "" {
+		return
+	}
+	pool, changed, err := e.tlsFiles.roots()
+	if err != nil {
+		log.Warnf("Failed to reload %s, keeping the current CAs. %s", e.tlsFiles.caFile, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	log.Infof("Reloaded CAs from %s", e.tlsFiles.caFile)
+	old := e.client.Transport.(*http.Transport)
+	t := old.Clone()
+	t.TLSClientConfig.RootCAs = pool
+	e.client.Transport = t
+	old.CloseIdleConnections()
+}
+
+// latestMtime returns the latest modification time of the files.
+func latestMtime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
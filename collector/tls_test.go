@@ -0,0 +1,243 @@
+package collector
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a private CA issuing certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key in PEM for name, a DNS name for
+// servers or a common name for clients.
+func (ca *testCA) issue(t *testing.T, name string, client bool) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to name in dir, with a modification time of mtime
+// so that rewrites within the same clock tick are noticed, and returns its path.
+func writeFile(t *testing.T, dir, name string, data []byte, mtime time.Time) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTLSAgent starts a mock monitor agent serving pluginsJSON over TLS with a
+// certificate of ca for name.
+func newTLSAgent(t *testing.T, ca *testCA, name string) *httptest.Server {
+	certPEM, keyPEM := ca.issue(t, name, false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := httptest.NewUnstartedServer(agentHandler(pluginsJSON))
+	agent.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	agent.StartTLS()
+	return agent
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestTLSServerName(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := newTestCA(t, "private CA")
+	caFile := writeFile(t, dir, "ca.pem", ca.pem, time.Now())
+	// The certificate is for fluentd.internal, the agent is dialed by IP.
+	agent := newTLSAgent(t, ca, "fluentd.internal")
+	defer agent.Close()
+
+	byIP := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, TLSCAFile: caFile})
+	if err := byIP.Scrape(); err == nil {
+		t.Error("scrape by IP verified a certificate for fluentd.internal")
+	}
+
+	byName := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, TLSCAFile: caFile, TLSServerName: "fluentd.internal"})
+	if err := byName.Scrape(); err != nil {
+		t.Errorf("scrape with the server name override failed: %s", err)
+	}
+}
+
+func TestClientCertReload(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := newTestCA(t, "private CA")
+	caFile := writeFile(t, dir, "ca.pem", ca.pem, time.Now())
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	clients := make(chan string, 2)
+	certPEM, keyPEM := ca.issue(t, "fluentd.internal", false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins := agentHandler(pluginsJSON)
+	agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+		// A new connection per request, each with a handshake.
+		w.Header().Set("Connection", "close")
+		plugins(w, r)
+	}))
+	agent.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	agent.StartTLS()
+	defer agent.Close()
+
+	mtime := time.Now().Add(-time.Minute)
+	certPEM, keyPEM = ca.issue(t, "client-1", true)
+	certFile := writeFile(t, dir, "client.pem", certPEM, mtime)
+	keyFile := writeFile(t, dir, "client-key.pem", keyPEM, mtime)
+	e := newTestExporter(t, ExporterOpts{
+		Endpoints:     []string{agent.URL},
+		TLSServerName: "fluentd.internal",
+		TLSCAFile:     caFile,
+		TLSCertFile:   certFile,
+		TLSKeyFile:    keyFile,
+	})
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("scrape with client-1: %s", err)
+	}
+	if cn := <-clients; cn != "client-1" {
+		t.Errorf("agent saw client %q, want client-1", cn)
+	}
+
+	// Renew the certificate in place.
+	certPEM, keyPEM = ca.issue(t, "client-2", true)
+	writeFile(t, dir, "client.pem", certPEM, mtime.Add(time.Second))
+	writeFile(t, dir, "client-key.pem", keyPEM, mtime.Add(time.Second))
+	if err := e.Scrape(); err != nil {
+		t.Fatalf("scrape after the renewal: %s", err)
+	}
+	if cn := <-clients; cn != "client-2" {
+		t.Errorf("agent saw client %q after the renewal, want client-2", cn)
+	}
+}
+
+func TestCAReload(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	oldCA, newCA := newTestCA(t, "old CA"), newTestCA(t, "new CA")
+	mtime := time.Now().Add(-time.Minute)
+	caFile := writeFile(t, dir, "ca.pem", oldCA.pem, mtime)
+
+	agent := newTLSAgent(t, newCA, "fluentd.internal")
+	defer agent.Close()
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, TLSServerName: "fluentd.internal", TLSCAFile: caFile})
+	if err := e.Scrape(); err == nil {
+		t.Fatal("scrape trusted a CA not in the CA file")
+	}
+
+	writeFile(t, dir, "ca.pem", newCA.pem, mtime.Add(time.Second))
+	if err := e.Scrape(); err != nil {
+		t.Errorf("scrape after the CA file changed: %s", err)
+	}
+}
+
+func TestCAAddedToSystemPool(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	ca := newTestCA(t, "private CA")
+	caFile := writeFile(t, dir, "ca.pem", ca.pem, time.Now())
+
+	f := &tlsFiles{caFile: caFile}
+	pool, _, err := f.roots()
+	if err != nil {
+		t.Fatalf("roots: %s", err)
+	}
+	system, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skipf("no system pool: %s", err)
+	}
+	if pool.Equal(system) {
+		t.Error("CA file not added to the system pool")
+	}
+	system.AppendCertsFromPEM(ca.pem)
+	if !pool.Equal(system) {
+		t.Error("pool isn't the system pool with the CA file added")
+	}
+
+	agent := newTLSAgent(t, ca, "fluentd.internal")
+	defer agent.Close()
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, TLSCAFile: caFile, TLSServerName: "fluentd.internal"})
+	if err := e.Scrape(); err != nil {
+		t.Errorf("scrape of an agent signed by the private CA failed: %s", err)
+	}
+}
@@ -0,0 +1,62 @@
+package collector
+
+import (
+	"sort"
+)
+
+// collapse keeps the ExporterOpts.TopK plugins with the largest
+// buffer_total_queued_size and merges the others of each worker into a
+// plugin with id and type "other", summing their buffer and retry fields so
+// totals are preserved. Emit counts are dropped, since the set of merged
+// plugins changes between scrapes.
+func (e *Exporter) collapse(plugins []Plugin) []Plugin {
+	if e.topK <= 0 || len(plugins) <= e.topK {
+		return plugins
+	}
+
+	sorted := append([]Plugin{}, plugins...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].TotalQueuedSize() > sorted[j].TotalQueuedSize()
+	})
+
+	kept := sorted[:e.topK]
+	others := map[string]*Plugin{}
+	var workers []string
+	for _, p := range sorted[e.topK:] {
+		other, ok := others[p.Worker]
+		if !ok {
+			other = &Plugin{
+				PluginId:     "other",
+				PluginType:   "other",
+				OutputPlugin: true,
+				Worker:       p.Worker,
+				ScrapedAt:    p.ScrapedAt,
+			}
+			others[p.Worker] = other
+			workers = append(workers, p.Worker)
+		}
+		other.BufQueueLength = addOptional(other.BufQueueLength, p.BufQueueLength)
+		other.BufStageLength = addOptional(other.BufStageLength, p.BufStageLength)
+		other.BufTotalQueuedSize = addOptional(other.BufTotalQueuedSize, p.BufTotalQueuedSize)
+		other.BufQueuedChunks = addOptional(other.BufQueuedChunks, p.BufQueuedChunks)
+		other.RetryCount += p.RetryCount
+	}
+
+	sort.Strings(workers)
+	for _, w := range workers {
+		kept = append(kept, *others[w])
+	}
+	return kept
+}
+
+// addOptional adds v to sum, keeping sum nil while no value was reported.
+func addOptional(sum, v *float64) *float64 {
+	if v == nil {
+		return sum
+	}
+	total := *v
+	if sum != nil {
+		total += *sum
+	}
+	return &total
+}
@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTopK(t *testing.T) {
+	var plugins []Plugin
+	for i := 1; i <= 10; i++ {
+		plugins = append(plugins, Plugin{
+			PluginId:           fmt.Sprintf("out_%d", i),
+			PluginType:         "s3",
+			OutputPlugin:       true,
+			BufQueueLength:     float(1),
+			BufTotalQueuedSize: float(float64(i * 100)),
+			RetryCount:         1,
+		})
+	}
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"buffer_queue_length", "buffer_total_queued_size", "retry_count"}, TopK: 3, CacheTTL: time.Hour})
+	applyPlugins(e, plugins...)
+	e.lastScrape = time.Now()
+	got := collect(t, e)
+
+	expectSamples(t, got, map[string]float64{
+		`fluentd_buffer_total_queued_size{pluginId="out_10",pluginType="s3",worker=""}`: 1000,
+		`fluentd_buffer_total_queued_size{pluginId="out_9",pluginType="s3",worker=""}`:  900,
+		`fluentd_buffer_total_queued_size{pluginId="out_8",pluginType="s3",worker=""}`:  800,
+		// out_1 to out_7.
+		`fluentd_buffer_total_queued_size{pluginId="other",pluginType="other",worker=""}`: 2800,
+		`fluentd_buffer_queue_length{pluginId="other",pluginType="other",worker=""}`:      7,
+		`fluentd_retry_count{pluginId="other",pluginType="other",worker=""}`:              7,
+		// Totals are preserved.
+		`fluentd_buffer_total_queued_size_all{}`: 5500,
+		`fluentd_retry_count_all{}`:              10,
+	})
+	if series := seriesOf(got, "fluentd_buffer_total_queued_size"); len(series) != 4 {
+		t.Errorf("got %v, want the top 3 and other", series)
+	}
+}
+
+func TestTopKBelowThreshold(t *testing.T) {
+	plugins := []Plugin{
+		{PluginId: "out_a", PluginType: "s3", OutputPlugin: true, BufTotalQueuedSize: float(1)},
+		{PluginId: "out_b", PluginType: "s3", OutputPlugin: true, BufTotalQueuedSize: float(2)},
+	}
+	e := newTestExporter(t, ExporterOpts{TopK: 2})
+	if got := e.collapse(plugins); len(got) != 2 || got[0].PluginId != "out_a" || got[1].PluginId != "out_b" {
+		t.Errorf("collapse of %d plugins with TopK 2 = %+v, want them unchanged", len(plugins), got)
+	}
+}
+
+func TestTopKKeepsStateOutsideTheTop(t *testing.T) {
+	e := newTestExporter(t, ExporterOpts{Metrics: []string{"plugin_emit_rate"}, TopK: 1, CacheTTL: time.Hour})
+	start := time.Now()
+	scrape := func(at time.Duration, bType string, bSize float64) {
+		applyPlugins(e,
+			Plugin{PluginId: "out_a", PluginType: "s3", OutputPlugin: true, BufTotalQueuedSize: float(100), EmitCount: float(0), ScrapedAt: start.Add(at)},
+			Plugin{PluginId: "out_b", PluginType: bType, OutputPlugin: true, BufTotalQueuedSize: float(bSize), EmitCount: float(at.Seconds()), ScrapedAt: start.Add(at)},
+		)
+		e.lastScrape = time.Now()
+	}
+	const changes = `fluentd_plugin_type_changes_total{pluginId="out_b",worker=""}`
+	const rate = `fluentd_plugin_emit_rate{pluginId="out_b",pluginType="gcs",worker=""}`
+
+	scrape(0, "s3", 1000)
+	scrape(10 * time.Second, "gcs", 1000)
+	expectSamples(t, collect(t, e.typeChanges), map[string]float64{changes: 1})
+
+	// out_b drops out of the top and comes back.
+	scrape(20 * time.Second, "gcs", 1)
+	expectSamples(t, collect(t, e.typeChanges), map[string]float64{changes: 1})
+	scrape(30 * time.Second, "gcs", 1000)
+	expectSamples(t, collect(t, e.typeChanges), map[string]float64{changes: 1})
+	// Its emit rate goes on from its last scrape in the top rather than
+	// starting over.
+	expectSamples(t, collect(t, e.pluginMetrics["plugin_emit_rate"]), map[string]float64{rate: 1})
+}
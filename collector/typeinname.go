@@ -0,0 +1,55 @@
+package collector
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// typedMetric returns the GaugeVec for plugin metric name of the given plugin
+// type with ExporterOpts.TypeInName, creating it on first use. It must be
+// called with the lock held.
+func (e *Exporter) typedMetric(name, pluginType string) *prometheus.GaugeVec {
+	typed := e.typedMetricName(name, pluginType)
+	if m, ok := e.typedMetrics[typed]; ok {
+		return m
+	}
+
+	var labelNames []string
+	for _, l := range e.pluginLabelNames[name] {
+		if l != e.typeLabel {
+			labelNames = append(labelNames, l)
+		}
+	}
+	m := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Name:      typed,
+		Help:      e.byteMetricHelp(name, pluginMetricHelp[name]),
+	}, labelNames)
+	e.typedMetrics[typed] = m
+	return m
+}
+
+// typedMetricName returns the name, without namespace, of plugin metric name
+// of the given plugin type with ExporterOpts.TypeInName.
+func (e *Exporter) typedMetricName(name, pluginType string) string {
+	typed := metricNameInvalidChars.ReplaceAllString(pluginType, "_") + "_" + e.byteMetricName(name)
+	if e.namespace == "" && typed[0] >= '0' && typed[0] <= '9' {
+		// Without a namespace the type starts the name, which can't be a digit.
+		typed = "_" + typed
+	}
+	return typed
+}
+
+// withoutLabel returns a copy of labels without name.
+func withoutLabel(labels prometheus.Labels, name string) prometheus.Labels {
+	l := make(prometheus.Labels, len(labels))
+	for k, v := range labels {
+		if k != name {
+			l[k] = v
+		}
+	}
+	return l
+}
@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTypeInName(t *testing.T) {
+	agent := newAgent(`{"plugins":[
+		{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_total_queued_size":2048,"retry_count":1},
+		{"plugin_id":"out_es","type":"elasticsearch-v2","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":100,"retry_count":0}
+	]}`)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, TypeInName: true})
+	got := collect(t, e)
+	expectSamples(t, got, map[string]float64{
+		`fluentd_s3_buffer_queue_length{pluginId="out_s3",worker=""}`:               3,
+		`fluentd_elasticsearch_v2_buffer_queue_length{pluginId="out_es",worker=""}`: 1,
+	})
+	if series := seriesOf(got, "fluentd_buffer_queue_length"); len(series) != 0 {
+		t.Errorf("got %v besides the per-type metrics", series)
+	}
+}
+
+func TestTypeInNameWithoutNamespace(t *testing.T) {
+	agent := newAgent(`{"plugins":[{"plugin_id":"out_kafka","type":"0kafka","output_plugin":true,"buffer_queue_length":2,"retry_count":0}]}`)
+	defer agent.Close()
+
+	e, err := NewExporter(ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, TypeInName: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	expectSamples(t, collect(t, e), map[string]float64{
+		`_0kafka_buffer_queue_length{pluginId="out_kafka",worker=""}`: 2,
+	})
+}
+
+// Collect sends the typed metrics under the read lock it already holds.
+// Taking it again would deadlock with a scrape waiting to apply in between.
+func TestTypeInNameConcurrentCollect(t *testing.T) {
+	agent := newAgent(pluginsJSON)
+	defer agent.Close()
+
+	e := newTestExporter(t, ExporterOpts{Endpoints: []string{agent.URL}, Metrics: []string{"buffer_queue_length"}, TypeInName: true})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			go e.Refresh()
+			if _, err := reg.Gather(); err != nil {
+				t.Errorf("Gather: %s", err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent collects and scrapes deadlocked")
+	}
+}
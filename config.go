@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// fileConfig is the format of -config.file.
+//
+//	targets:
+//	  - name: aggregator-1
+//	    endpoints: [http://10.0.0.1:24220]
+//	    labels: {team: logging}
+//	    timeout: 15s
+type fileConfig struct {
+	Targets []targetConfig `yaml:"targets"`
+}
+
+// targetConfig is one target of fileConfig. Settings it doesn't have come
+// from the command line flags.
+type targetConfig struct {
+	Name      string            `yaml:"name"`
+	Endpoints []string          `yaml:"endpoints"`
+	Labels    map[string]string `yaml:"labels"` // added to every metric of the target
+	Timeout   time.Duration     `yaml:"timeout"`
+}
+
+// target is one logical Fluentd target, scraped by its own Exporter.
+type target struct {
+	name   string // value of the target label, empty without a config file
+	labels prometheus.Labels
+	opts   collector.ExporterOpts
+}
+
+// loadTargets returns the targets to scrape, one per entry of -config.file,
+// -fluentd.endpoints or -discovery.dns-srv or a single one from the flags, and
+// the modification time of the config file.
+func loadTargets() ([]target, time.Time, error) {
+	if *srvName != "" {
+		endpoints, err := resolveSRV(net.LookupSRV, *srvName)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return srvTargets(endpoints)
+	}
+	// The port range is of -fluentd.endpoint, which the targets replace.
+	if *workerPortRange != "" && (*configFile != "" || *targetEndpoints != "") {
+		return nil, time.Time{}, fmt.Errorf("-fluentd.worker-port-range can't be used with -config.file or -fluentd.endpoints")
+	}
+	base, err := exporterOpts()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if *targetEndpoints != "" {
+		if *configFile != "" {
+			return nil, time.Time{}, fmt.Errorf("-fluentd.endpoints and -config.file can't be used together")
+		}
+		targets, err := endpointTargets(base, splitList(*targetEndpoints))
+		return targets, time.Time{}, err
+	}
+	if *configFile == "" {
+		return []target{{opts: base}}, time.Time{}, nil
+	}
+
+	info, err := os.Stat(*configFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var cfg fileConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse %s. %s", *configFile, err)
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, time.Time{}, fmt.Errorf("no targets in %s", *configFile)
+	}
+
+	seen := map[string]bool{}
+	var targets []target
+	for i, tc := range cfg.Targets {
+		if tc.Name == "" {
+			return nil, time.Time{}, fmt.Errorf("target %d in %s has no name", i, *configFile)
+		}
+		if seen[tc.Name] {
+			return nil, time.Time{}, fmt.Errorf("duplicate target %q in %s", tc.Name, *configFile)
+		}
+		seen[tc.Name] = true
+		if len(tc.Endpoints) == 0 {
+			return nil, time.Time{}, fmt.Errorf("target %q in %s has no endpoints", tc.Name, *configFile)
+		}
+		for name := range tc.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") || name == "target" {
+				return nil, time.Time{}, fmt.Errorf("target %q in %s has invalid label name %q", tc.Name, *configFile, name)
+			}
+		}
+
+		opts := base
+		opts.Endpoints = nil
+		for _, ep := range tc.Endpoints {
+			opts.Endpoints = append(opts.Endpoints, strings.TrimRight(ep, "/"))
+		}
+		if tc.Timeout < 0 {
+			return nil, time.Time{}, fmt.Errorf("target %q in %s has a negative timeout", tc.Name, *configFile)
+		}
+		if tc.Timeout != 0 {
+			opts.Timeout = tc.Timeout
+		}
+		targets = append(targets, target{name: tc.Name, labels: tc.Labels, opts: opts})
+	}
+	return targets, info.ModTime(), nil
+}
+
+// srvTargets returns the targets of the endpoints -discovery.dns-srv resolved
+// to, see resolveSRV.
+func srvTargets(endpoints []string) ([]target, time.Time, error) {
+	if *configFile != "" || *targetEndpoints != "" {
+		return nil, time.Time{}, fmt.Errorf("-discovery.dns-srv can't be used with -config.file or -fluentd.endpoints")
+	}
+	if *workerPortRange != "" {
+		return nil, time.Time{}, fmt.Errorf("-fluentd.worker-port-range can't be used with -discovery.dns-srv")
+	}
+	base, err := exporterOpts()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	targets, err := endpointTargets(base, endpoints)
+	return targets, time.Time{}, err
+}
+
+// endpointTargets returns a target per endpoint of -fluentd.endpoints or
+// -discovery.dns-srv, named after the endpoint's host. base can't have settings
+// for -fluentd.endpoint, which the endpoints replace.
+func endpointTargets(base collector.ExporterOpts, endpoints []string) ([]target, error) {
+	if base.Fallback != "" {
+		return nil, fmt.Errorf("-fluentd.fallback-endpoint can't be used with several targets")
+	}
+	if len(base.Endpoints) > 1 {
+		return nil, fmt.Errorf("several -fluentd.endpoint workers can't be used with several targets")
+	}
+
+	seen := map[string]bool{}
+	var targets []target
+	for _, ep := range endpoints {
+		u, err := url.Parse(ep)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q", ep)
+		}
+		if seen[u.Host] {
+			return nil, fmt.Errorf("duplicate endpoint host %q", u.Host)
+		}
+		seen[u.Host] = true
+
+		opts := base
+		opts.Endpoints = []string{strings.TrimRight(ep, "/")}
+		targets = append(targets, target{name: u.Host, opts: opts})
+	}
+	return targets, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeConfig writes a -config.file with a single target and sets the flag to
+// it. The returned func restores the flag.
+func writeConfig(t *testing.T, dir, content string) func() {
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := *configFile
+	*configFile = path
+	return func() { *configFile = old }
+}
+
+// gaugeValue returns the value of the unlabeled gauge name in the static
+// metrics of r.
+func gaugeValue(t *testing.T, r *reloader, name string) (float64, bool) {
+	mfs, err := r.registry().static.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %s", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestConfigFileMtime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer writeConfig(t, dir, `
+targets:
+  - name: aggregator-1
+    endpoints: [http://127.0.0.1:24220]
+`)()
+
+	mtime := time.Date(2019, 6, 1, 12, 30, 15, 0, time.UTC)
+	if err := os.Chtimes(*configFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newReloader(loadTargets)
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	if v, ok := gaugeValue(t, r, "fluentd_config_file_mtime_seconds"); !ok || v != 1559392215 {
+		t.Errorf("config_file_mtime_seconds = %g (%t), want 1559392215", v, ok)
+	}
+
+	mtime = mtime.Add(time.Hour)
+	if err := os.Chtimes(*configFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if v, _ := gaugeValue(t, r, "fluentd_config_file_mtime_seconds"); v != 1559395815 {
+		t.Errorf("config_file_mtime_seconds after the reload = %g, want 1559395815", v)
+	}
+}
+
+func TestConfigFileMtimeWithoutConfig(t *testing.T) {
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts("http://127.0.0.1:24220")}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	if _, ok := gaugeValue(t, r, "fluentd_config_file_mtime_seconds"); ok {
+		t.Error("config_file_mtime_seconds exposed without -config.file")
+	}
+}
+
+func TestTargetLabels(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer writeConfig(t, dir, `
+targets:
+  - name: aggregator-1
+    endpoints: [`+agent.URL+`]
+    labels: {team: logging, region: tokyo}
+  - name: aggregator-2
+    endpoints: [`+agent.URL+`]
+    labels: {team: search}
+`)()
+
+	r, err := newReloader(loadTargets)
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	body := scrapeBody(t, r)
+	for _, want := range []string{
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",region="tokyo",target="aggregator-1",team="logging",worker=""} 3`,
+		`fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",region="",target="aggregator-2",team="search",worker=""} 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+}
+
+func TestTargetLabelClash(t *testing.T) {
+	for _, name := range []string{"pluginId", "worker", "cause"} {
+		_, err := newRegistry([]target{{
+			name:   "aggregator-1",
+			labels: prometheus.Labels{name: "x"},
+			opts:   testOpts("http://127.0.0.1:24220"),
+		}}, time.Time{})
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("label %s: newRegistry returned %v, want a clash", name, err)
+		}
+	}
+}
+
+func TestTargetTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, pluginsJSON)
+	}))
+	defer slow.Close()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer writeConfig(t, dir, `
+targets:
+  - name: global-timeout
+    endpoints: [`+slow.URL+`]
+  - name: own-timeout
+    endpoints: [`+slow.URL+`]
+    timeout: 2s
+`)()
+	old := *timeout
+	*timeout = 50 * time.Millisecond
+	defer func() { *timeout = old }()
+
+	r, err := newReloader(loadTargets)
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	body := scrapeBody(t, r)
+	for _, want := range []string{
+		`fluentd_last_scrape_error{target="global-timeout"} 1`,
+		`fluentd_last_scrape_error{target="own-timeout"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+}
+
+func TestEndpointsShorthand(t *testing.T) {
+	var urls []string
+	for i := 0; i < 3; i++ {
+		agent := newAgent()
+		defer agent.Close()
+		urls = append(urls, agent.URL)
+	}
+	old := *targetEndpoints
+	*targetEndpoints = strings.Join(urls, ",")
+	defer func() { *targetEndpoints = old }()
+
+	r, err := newReloader(loadTargets)
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	body := scrapeBody(t, r)
+	for _, u := range urls {
+		want := `fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",target="` + strings.TrimPrefix(u, "http://") + `",worker=""} 3`
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+}
+
+func TestEndpointsShorthandInvalid(t *testing.T) {
+	for _, endpoints := range []string{
+		"localhost:24220",
+		"ftp://localhost:24220",
+		"http://localhost:24220,http://localhost:24220/",
+	} {
+		if _, err := endpointTargets(testOpts(""), splitList(endpoints)); err == nil {
+			t.Errorf("endpointTargets accepted %q", endpoints)
+		}
+	}
+}
+
+func TestEndpointsShorthandEndpointSettings(t *testing.T) {
+	fallback := testOpts("http://localhost:24220")
+	fallback.Fallback = "http://localhost:24230"
+	workers := testOpts("")
+	workers.Endpoints = []string{"http://localhost:24220", "http://localhost:24221"}
+	for name, base := range map[string]collector.ExporterOpts{"fallback": fallback, "workers": workers} {
+		if _, err := endpointTargets(base, []string{"http://10.0.0.1:24220", "http://10.0.0.2:24220"}); err == nil {
+			t.Errorf("endpointTargets dropped the %s of -fluentd.endpoint", name)
+		}
+	}
+}
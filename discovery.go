@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// srvLookup looks up SRV records like net.LookupSRV.
+type srvLookup func(service, proto, name string) (string, []*net.SRV, error)
+
+// resolveSRV returns an http endpoint per SRV record of name, sorted.
+func resolveSRV(lookup srvLookup, name string) ([]string, error) {
+	_, records, err := lookup("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", name)
+	}
+
+	var endpoints []string
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		endpoints = append(endpoints, "http://" + net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+// watchSRV re-resolves name every interval and reloads r with the targets of
+// the records when they changed. Resolution errors keep the current targets.
+func watchSRV(lookup srvLookup, name string, interval time.Duration, r *reloader) {
+	last, _ := resolveSRV(lookup, name)
+	for range time.Tick(interval) {
+		endpoints, err := resolveSRV(lookup, name)
+		if err != nil {
+			log.Warnf("Failed to resolve %s, keeping the current targets. %s", name, err)
+			continue
+		}
+		if reflect.DeepEqual(endpoints, last) {
+			continue
+		}
+		if err := r.reloadWith(func() ([]target, time.Time, error) { return srvTargets(endpoints) }); err != nil {
+			log.Errorf("Failed to reload after %s changed. %s", name, err)
+			continue
+		}
+		log.Infof("Reloaded exporter with targets from %s: %s", name, strings.Join(endpoints, ", "))
+		last = endpoints
+	}
+}
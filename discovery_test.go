@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers SRV lookups with its current records.
+type stubResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	err     error
+}
+
+func (s *stubResolver) set(records []*net.SRV, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records, s.err = records, err
+}
+
+func (s *stubResolver) lookup(service, proto, name string) (string, []*net.SRV, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return name, s.records, s.err
+}
+
+func TestResolveSRV(t *testing.T) {
+	var s stubResolver
+	s.set([]*net.SRV{
+		{Target: "fluentd-2.example.com.", Port: 24220},
+		{Target: "fluentd-1.example.com.", Port: 24221},
+	}, nil)
+
+	endpoints, err := resolveSRV(s.lookup, "_fluentd._tcp.example.com")
+	if err != nil {
+		t.Fatalf("resolveSRV: %s", err)
+	}
+	want := []string{"http://fluentd-1.example.com:24221", "http://fluentd-2.example.com:24220"}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("resolveSRV = %v, want %v", endpoints, want)
+	}
+
+	targets, err := endpointTargets(testOpts(""), endpoints)
+	if err != nil {
+		t.Fatalf("endpointTargets: %s", err)
+	}
+	for i, name := range []string{"fluentd-1.example.com:24221", "fluentd-2.example.com:24220"} {
+		if targets[i].name != name {
+			t.Errorf("target %d is named %q, want %q", i, targets[i].name, name)
+		}
+	}
+
+	s.set(nil, nil)
+	if _, err := resolveSRV(s.lookup, "_fluentd._tcp.example.com"); err == nil {
+		t.Error("resolveSRV succeeded without records")
+	}
+}
+
+func TestWatchSRV(t *testing.T) {
+	const name = "_fluentd._tcp.example.com"
+	var s stubResolver
+	s.set([]*net.SRV{{Target: "fluentd-1.example.com.", Port: 24220}}, nil)
+	endpoints, err := resolveSRV(s.lookup, name)
+	if err != nil {
+		t.Fatalf("resolveSRV: %s", err)
+	}
+	r, err := newReloader(func() ([]target, time.Time, error) { return srvTargets(endpoints) })
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	first := r.registry()
+
+	go watchSRV(s.lookup, name, 10 * time.Millisecond, r)
+	// Neither unchanged records nor a failed lookup reload.
+	time.Sleep(50 * time.Millisecond)
+	s.set(nil, fmt.Errorf("lookup failed"))
+	time.Sleep(50 * time.Millisecond)
+	if r.registry() != first {
+		t.Fatal("reloaded without a change of the records")
+	}
+
+	s.set([]*net.SRV{{Target: "fluentd-1.example.com.", Port: 24220}, {Target: "fluentd-2.example.com.", Port: 24220}}, nil)
+	for deadline := time.Now().Add(time.Second); r.registry() == first; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("didn't reload after the records changed")
+		}
+	}
+	// The targets are those of the records that changed, not of another lookup.
+	var names []string
+	for _, target := range r.registry().targets {
+		names = append(names, target.name)
+	}
+	if want := []string{"fluentd-1.example.com:24220", "fluentd-2.example.com:24220"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("reloaded with targets %v, want %v", names, want)
+	}
+}
+
+func TestSRVTargetsWorkerPortRange(t *testing.T) {
+	old := *workerPortRange
+	defer func() { *workerPortRange = old }()
+	*workerPortRange = "24220-24221"
+	if _, _, err := srvTargets([]string{"http://fluentd-1.example.com:24220"}); err == nil {
+		t.Error("srvTargets accepted -fluentd.worker-port-range")
+	}
+}
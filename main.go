@@ -1,231 +1,337 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
 	"github.com/prometheus/common/log"
 	"net"
 	"net/http"
-	"sync"
+	"net/url"
 	"time"
-	"io/ioutil"
-	"encoding/json"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"strings"
 )
 
 var (
 	VERSION = "0.0.1"
+	REVISION = "" // set with -ldflags "-X main.REVISION=..."
 
 	showVersion = flag.Bool("version", false, "Show version information")
-	namespace = flag.String("namespace", "fluentd", "Namespace for metrics.")
-	listenAddress = flag.String("web.listen-address", ":9121", "Address to listen on for web interface and telemetry.")
+	versionOutput = flag.String("output", "text", "Format of -version: text or json.")
+	configFile = flag.String("config.file", "", "YAML file listing the targets to scrape, each with its own endpoints and a target label. Reloaded on SIGHUP.")
+	srvName = flag.String("discovery.dns-srv", "", "DNS SRV record, e.g. _fluentd._tcp.example.com, whose records are scraped as separate http targets labeled target=\"<host:port>\".")
+	srvInterval = flag.Duration("discovery.refresh-interval", 30 * time.Second, "Interval between resolutions of -discovery.dns-srv.")
+	namespace = flag.String("namespace", "fluentd", "Namespace for metrics. Empty for unprefixed metric names, e.g. buffer_queue_length.")
+	listenAddress = newListFlag("web.listen-address", []string{":9121"}, "Address to listen on for web interface and telemetry. Repeat to listen on several addresses. No HTTP server when empty.")
 	metricPath = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-	endpoint = flag.String("fluentd.endpoint", "http://localhost:24220", "Fluentd monitor agent endpoint.")
+	readHeaderTimeout = flag.Duration("web.read-header-timeout", 10 * time.Second, "Maximum time to read the headers of a request.")
+	readTimeout = flag.Duration("web.read-timeout", 30 * time.Second, "Maximum time to read a whole request.")
+	writeTimeout = flag.Duration("web.write-timeout", time.Minute, "Maximum time to answer a request, including the scrape of Fluentd.")
+	idleTimeout = flag.Duration("web.idle-timeout", 2 * time.Minute, "Maximum time to keep an idle keep-alive connection open.")
+	maxRequests = flag.Int("web.max-requests", 0, "Maximum number of concurrent metrics requests; more are answered with 503. Unlimited when 0.")
+	varsPath = flag.String("web.vars-path", "", "Path under which to expose the metrics as expvar-style JSON, e.g. /debug/vars. Disabled when empty.")
+	adminToken = flag.String("web.admin-token", "", "Token POST /-/scrape requests have to send as \"Authorization: Bearer <token>\". POST /-/scrape is disabled when empty.")
+	routePrefix = flag.String("web.route-prefix", "", "Prefix for all HTTP routes, e.g. /fluentd-exporter when served under that path by a reverse proxy.")
+	checkOnly = flag.Bool("check", false, "Scrape every target once and exit: 0 on success, 1 printing the reason otherwise. For readiness checks.")
+	scrapeOnStart = flag.Bool("startup.scrape-on-start", false, "Scrape Fluentd once before starting to serve metrics.")
+	failOnStartError = flag.Bool("startup.fail-on-error", true, "Exit when the -startup.scrape-on-start scrape fails.")
+	textfileOutput = flag.String("textfile.output", "", "File to periodically write the Fluentd metrics to in the text format, for node_exporter's textfile collector. The Go and process metrics of the exporter are left out.")
+	textfileInterval = flag.Duration("textfile.interval", time.Minute, "Interval between writes of -textfile.output.")
+	statsdAddress = flag.String("statsd.address", "", "host:port of a StatsD server to periodically push the plugin metrics to as gauges over UDP. Disabled when empty.")
+	statsdInterval = flag.Duration("statsd.interval", 10 * time.Second, "Interval between pushes to -statsd.address.")
+	otlpEndpoint = flag.String("otlp.endpoint", "", "Base URL of an OTLP/HTTP receiver, e.g. http://localhost:4318, to periodically push the Fluentd metrics to as JSON. Disabled when empty.")
+	otlpInterval = flag.Duration("otlp.interval", 10 * time.Second, "Interval between pushes to -otlp.endpoint.")
+	endpoint = flag.String("fluentd.endpoint", "http://localhost:24220", "Fluentd monitor agent endpoint. Comma-separated list to scrape several workers as one target.")
+	targetEndpoints = flag.String("fluentd.endpoints", "", "Comma-separated list of Fluentd monitor agent endpoints scraped as separate targets, labeled target=\"<host:port>\". Overrides -fluentd.endpoint.")
+	workerPortRange = flag.String("fluentd.worker-port-range", "", "Port range, e.g. 24220-24223, of a worker-per-port Fluentd: scrapes the host of -fluentd.endpoint on every port, labeled worker=\"<index>\".")
+	dialAddress = flag.String("fluentd.dial-address", "", "host:port to connect to instead of the endpoint's host, e.g. a local ssh -L forward. The Host header still comes from the endpoint.")
+	tlsCAFile = flag.String("fluentd.tls-ca-file", "", "PEM file of CAs to trust for the agent's certificate in addition to the system CAs. Re-read when it changes.")
+	tlsCertFile = flag.String("fluentd.tls-cert-file", "", "PEM client certificate to present to the agent. Re-read when it changes.")
+	tlsKeyFile = flag.String("fluentd.tls-key-file", "", "PEM key of -fluentd.tls-cert-file.")
+	tlsServerName = flag.String("fluentd.tls-server-name", "", "Server name to verify the agent's TLS certificate against instead of the endpoint's host, e.g. when scraping by IP.")
 	timeout = flag.Duration("fluentd.timeout", 5 * time.Second, "Timeout for trying to get stats from Fluentd.")
+	fallbackEndpoint = flag.String("fluentd.fallback-endpoint", "", "Fluentd monitor agent endpoint to try when -fluentd.endpoint fails. Only with a single endpoint.")
+	fetchRetries = flag.Int("fluentd.fetch-retries", 0, "Number of times a failed fetch from an endpoint is retried within a scrape. No retries when 0.")
+	failureThreshold = flag.Int("fluentd.failure-threshold", 0, "Number of consecutive failed fetches after which an endpoint is not fetched for -fluentd.failure-cooldown. Disabled when 0.")
+	failureCooldown = flag.Duration("fluentd.failure-cooldown", time.Minute, "How long to stop fetching from an endpoint that reached -fluentd.failure-threshold.")
+	lockTimeout = flag.Duration("fluentd.lock-timeout", 0, "How long a metrics request waits for a scrape already in flight before serving the previous metrics with fluentd_last_scrape_error=1. No limit when 0.")
+	maxResponseBytes = flag.Int64("fluentd.max-response-bytes", 64 << 20, "Maximum size of an agent response in bytes. Unlimited when 0.")
+	strictDecode = flag.Bool("fluentd.strict-decode", false, "Fail the scrape when the agent response has fields the exporter does not know.")
+	allPlugins = flag.Bool("fluentd.scrape-all-plugins", false, "Also scrape input and filter plugins for fluentd_plugin_is_output. Every other metric still covers output plugins only.")
+	agentConfig = flag.Bool("fluentd.scrape-config", false, "Also scrape /api/config.json and expose fluentd_config_info and the worker pid and start time.")
+	followRedirects = flag.Bool("fluentd.follow-redirects", false, "Follow redirects from the agent. When false a redirect fails the scrape.")
+	allowJSONP = flag.Bool("fluentd.allow-jsonp", false, "Strip a JSONP callback wrapping the agent response, e.g. added by a misconfigured proxy.")
+	cacheTTL = flag.Duration("fluentd.cache-ttl", 0, "Serve the last scrape result for this long instead of fetching again. Disabled when 0.")
+	tagFilter = flag.String("fluentd.tag-filter", "", "Tag passed to the agent as /api/plugins.json?tag= so it only reports the plugins matching it. Agents without support report all plugins.")
+	pluginTypeAllow = flag.String("fluentd.plugin-type-allow", "", "Comma-separated list of plugin types to scrape. All types when empty.")
+	pluginTypeDeny = flag.String("fluentd.plugin-type-deny", "", "Comma-separated list of plugin types not to scrape. Takes precedence over -fluentd.plugin-type-allow.")
+	idLabelTemplate = flag.String("metrics.id-label-template", "", "Regexp with named groups; the groups of a matching pluginId are added as labels.")
+	namespaceFromIDPrefix = flag.Bool("metrics.namespace-from-id-prefix", false, "Add a logical_namespace label to plugin metrics: the pluginId up to its first underscore, e.g. app1 for app1_s3.")
+	snakeCaseLabels = flag.Bool("metrics.snake-case-labels", false, "Use plugin_type and plugin_id instead of pluginType and pluginId as label names.")
+	pluginConfig = flag.Bool("metrics.plugin-config", false, "Expose metrics derived from each plugin's config, e.g. plugin_retry_config_info.")
+	retryTimeoutFraction = flag.Float64("metrics.retry-timeout-fraction", 0.8, "Share of retry_timeout a plugin has to have been retrying for to count in fluentd_plugins_near_retry_timeout. Needs -metrics.plugin-config.")
+	zeroMissing = flag.Bool("metrics.zero-missing", false, "Expose buffer metrics of non-buffered plugins as 0 with a buffered=\"false\" label instead of skipping them.")
+	topK = flag.Int("metrics.topk", 0, "Expose plugin metrics of only the K plugins with the largest buffer_total_queued_size, summing the others into pluginId=\"other\". All plugins when 0.")
+	byteUnit = flag.String("metrics.byte-unit", "bytes", "Unit to scale byte-valued metrics to: bytes, kib or mib. Their names say the unit, e.g. fluentd_buffer_total_queued_size_mib.")
+	holdLastGood = flag.Bool("metrics.hold-last-good", false, "Keep the metrics of the last successful scrape when a scrape fails, only setting fluentd_up to 0, rather than resetting them.")
+	typeInName = flag.Bool("metrics.type-in-name", false, "Put the plugin type into plugin metric names, e.g. fluentd_s3_buffer_queue_length, instead of a pluginType label.")
+	metricsEnabled = flag.String("metrics.enabled", "buffer_queue_length,buffer_total_queued_size,retry_count", "Comma-separated list of plugin metrics to expose.")
 )
 
-type Exporter struct {
-	endpoint          string
-	namespace         string
-	client            *http.Client
-
-	duration          prometheus.Gauge
-	totalScrapes      prometheus.Counter
-	error             prometheus.Gauge
-	totalErrors       prometheus.Counter
-
-	bufQueueLength    *prometheus.GaugeVec // buffer_queue_length
-	bufTotalQueueSize *prometheus.GaugeVec // buffer_total_queued_size
-	retryCount        *prometheus.GaugeVec // retry_count
-
-	sync.RWMutex
-}
-
-func NewExporter(endpoint string, namespace string, timeout time.Duration) *Exporter {
-	e := Exporter{
-		endpoint:  endpoint,
-		namespace: namespace,
-		client: &http.Client{
-			Transport: &http.Transport{
-				Dial: func(netw, addr string) (net.Conn, error) {
-					c, err := net.DialTimeout(netw, addr, timeout)
-					if err != nil {
-						return nil, err
-					}
-					if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
-						return nil, err
-					}
-					return c, nil
-				},
-			},
-		},
-		duration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "last_scrape_duration_seconds",
-			Help:      "Duration of the last scrape of metrics from Fluentd.",
-		}),
-		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "scrapes_total",
-			Help:      "Total number of times Fluentd was scraped for metrics.",
-		}),
-		error: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "last_scrape_error",
-			Help:      "Whether the last scrape of metrics from Fluentd resulted in an error (1 for error, 0 for success).",
-		}),
-		totalErrors: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "scrape_errors_total",
-			Help:      "Total count of error scraping Fluentd.",
-		}),
-		bufQueueLength: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "buffer_queue_length",
-			Help:      "buffer_queue_length",
-		}, []string{"pluginType", "pluginId"}),
-		bufTotalQueueSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "buffer_total_queued_size",
-			Help:      "buffer_total_queued_size",
-		}, []string{"pluginType", "pluginId"}),
-		retryCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "retry_count",
-			Help:      "retry_count",
-		}, []string{"pluginType", "pluginId"}),
-	}
-
-	return &e
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-func (e *Exporter) Describe(ch chan <- *prometheus.Desc) {
-	ch <- e.duration.Desc()
-	ch <- e.totalScrapes.Desc()
-	ch <- e.error.Desc()
+// expandPortRange returns an endpoint per port of portRange ("first-last") on
+// the host of endpoint, and the worker index of each.
+func expandPortRange(endpoint, portRange string) ([]string, []string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return nil, nil, fmt.Errorf("invalid -fluentd.worker-port-range %q, want first-last", portRange)
+	}
+	first, err1 := strconv.Atoi(bounds[0])
+	last, err2 := strconv.Atoi(bounds[1])
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return nil, nil, fmt.Errorf("invalid -fluentd.worker-port-range %q, want first-last", portRange)
+	}
 
-	e.bufQueueLength.Describe(ch);
-	e.bufTotalQueueSize.Describe(ch);
-	e.retryCount.Describe(ch);
+	var endpoints, workers []string
+	for port := first; port <= last; port++ {
+		w := *u
+		w.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+		endpoints = append(endpoints, w.String())
+		workers = append(workers, strconv.Itoa(port - first))
+	}
+	return endpoints, workers, nil
 }
 
-func (e *Exporter) Collect(ch chan <- prometheus.Metric) {
-	e.Lock()
-	defer e.Unlock()
-
-	pluginChan := make(chan plugin)
-	go e.scrape(pluginChan)
-	e.setMetrics(pluginChan)
+// exporterOpts builds the collector.ExporterOpts from the command line flags.
+func exporterOpts() (collector.ExporterOpts, error) {
+	var endpoints []string
+	for _, ep := range splitList(*endpoint) {
+		endpoints = append(endpoints, strings.TrimRight(ep, "/"))
+	}
+	if len(endpoints) == 0 && *configFile == "" {
+		return collector.ExporterOpts{}, fmt.Errorf("no Fluentd endpoint given")
+	}
+	var workerLabels []string
+	if *workerPortRange != "" {
+		if len(endpoints) != 1 {
+			return collector.ExporterOpts{}, fmt.Errorf("-fluentd.worker-port-range needs a single -fluentd.endpoint")
+		}
+		var err error
+		if endpoints, workerLabels, err = expandPortRange(endpoints[0], *workerPortRange); err != nil {
+			return collector.ExporterOpts{}, err
+		}
+	}
+	if *fallbackEndpoint != "" && len(endpoints) > 1 {
+		return collector.ExporterOpts{}, fmt.Errorf("-fluentd.fallback-endpoint can only be used with a single endpoint")
+	}
 
-	ch <- e.duration
-	ch <- e.totalScrapes
-	ch <- e.error
-	ch <- e.totalErrors
+	return collector.ExporterOpts{
+		Endpoints:             endpoints,
+		WorkerLabels:          workerLabels,
+		Fallback:              strings.TrimRight(*fallbackEndpoint, "/"),
+		Namespace:             *namespace,
+		Timeout:               *timeout,
+		DialAddress:           *dialAddress,
+		TLSServerName:         *tlsServerName,
+		TLSCAFile:             *tlsCAFile,
+		TLSCertFile:           *tlsCertFile,
+		TLSKeyFile:            *tlsKeyFile,
+		CacheTTL:              *cacheTTL,
+		StrictDecode:          *strictDecode,
+		MaxResponseBytes:      *maxResponseBytes,
+		Metrics:               append([]string{}, splitList(*metricsEnabled)...), // not nil, so that an empty flag exposes none
+		PluginTypeAllow:       splitList(*pluginTypeAllow),
+		PluginTypeDeny:        splitList(*pluginTypeDeny),
+		IDLabelTemplate:       *idLabelTemplate,
+		SnakeCaseLabels:       *snakeCaseLabels,
+		ExposeConfig:          *pluginConfig,
+		AgentConfig:           *agentConfig,
+		FollowRedirects:       *followRedirects,
+		ZeroMissing:           *zeroMissing,
+		AllPlugins:            *allPlugins,
+		AllowJSONP:            *allowJSONP,
+		TypeInName:            *typeInName,
+		ByteUnit:              *byteUnit,
+		NamespaceFromIDPrefix: *namespaceFromIDPrefix,
+		TagFilter:             *tagFilter,
+		TopK:                  *topK,
+		LockTimeout:           *lockTimeout,
+		HoldLastGood:          *holdLastGood,
+		RetryTimeoutFraction:  *retryTimeoutFraction,
+		FetchRetries:          *fetchRetries,
+		FailureThreshold:      *failureThreshold,
+		FailureCooldown:       *failureCooldown,
+	}, nil
+}
 
-	e.bufQueueLength.Collect(ch)
-	e.bufTotalQueueSize.Collect(ch)
-	e.retryCount.Collect(ch)
+// check scrapes every exporter once and returns the first error.
+func check(exporters []*collector.Exporter) error {
+	for _, exporter := range exporters {
+		if err := exporter.Scrape(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (e *Exporter) fetch() ([]byte, error) {
-	res, err := e.client.Get(e.endpoint + "/api/plugins.json")
-	if err != nil {
-		return nil, err
+// versionString returns the version in the -output format, text or json.
+func versionString(output string) (string, error) {
+	switch output {
+	case "text":
+		return fmt.Sprintf("Fluentd monitor agent exporter v%s\n", VERSION), nil
+	case "json":
+		b, err := json.Marshal(map[string]string{
+			"version":   VERSION,
+			"revision":  REVISION,
+			"goVersion": runtime.Version(),
+		})
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
 	}
-	defer res.Body.Close()
+	return "", fmt.Errorf("-output must be text or json, got %q", output)
+}
 
-	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
-		return nil, err
+// initialScrape scrapes every exporter once before the exporter starts
+// serving. A failed scrape is only logged unless failOnError is set, in which
+// case its error is returned.
+func initialScrape(exporters []*collector.Exporter, failOnError bool) error {
+	for _, exporter := range exporters {
+		if err := exporter.Scrape(); err != nil {
+			if failOnError {
+				return err
+			}
+			log.Warnf("Initial scrape failed, serving anyway. %s", err)
+		}
 	}
+	return nil
+}
 
-	bodyByte, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+// routes registers the handlers of the exporter on mux under routePrefix and
+// returns the path of the metrics.
+func routes(mux *http.ServeMux, routePrefix string, current *reloader) (string, error) {
+	prefix := strings.TrimRight(routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("-web.route-prefix must start with /, got %q", routePrefix)
 	}
+	metricsURL := prefix + *metricPath
 
-	return bodyByte, nil
+	mux.Handle(metricsURL, current)
+	// Forced scrapes bypass the cache, so only offer them behind a token and
+	// within -web.max-requests.
+	if *adminToken != "" {
+		mux.Handle(prefix + "/-/scrape", limitRequests(*maxRequests, scrapeHandler(current, *adminToken)))
+	}
+	if *varsPath != "" {
+		mux.Handle(prefix + *varsPath, varsHandler(current))
+	}
+	mux.HandleFunc(prefix + "/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+<head><title>Fluentd monitor agent exporter</title></head>
+<body>
+<h1>Fluentd monitor agent exporter</h1>
+<p><a href='` + metricsURL + `'>Metrics</a></p>
+</body>
+</html>`))
+	})
+	return metricsURL, nil
 }
 
-func (e *Exporter) scrape(pluginChan chan <- plugin) {
-	defer close(pluginChan)
-	now := time.Now().UnixNano()
-	e.totalScrapes.Inc()
-	error := 0
+func main() {
+	flag.Parse()
 
-	bodyBytes, err := e.fetch();
-	if err != nil {
-		log.Errorf("Failed to fetch json. %s", err)
-		error = 1
-	} else {
-		var body pluginsBody
-		err = json.Unmarshal(bodyBytes, &body)
+	if *showVersion {
+		version, err := versionString(*versionOutput)
 		if err != nil {
-			log.Errorf("Failed to decode json. %s", err)
-			error = 1
-		} else {
-			for _, plugin := range body.Plugins {
-				if plugin.OutputPlugin {
-					pluginChan <- plugin
-				}
-			}
+			log.Fatal(err)
 		}
+		fmt.Print(version)
+		return
 	}
 
-	e.error.Set(float64(error))
-	if error == 1 {
-		e.totalErrors.Inc()
+	current, err := newReloader(loadTargets)
+	if err != nil {
+		log.Fatalf("Failed to create exporter. %s", err)
 	}
-	e.duration.Set(float64(time.Now().UnixNano() - now) / 1000000000)
-}
 
-func (e *Exporter) setMetrics(pluginChan <-chan plugin) {
-	for plugin := range pluginChan {
-		var labels prometheus.Labels = map[string]string{
-			"pluginType": plugin.PluginType,
-			"pluginId": plugin.PluginId,
+	if *checkOnly {
+		if err := check(current.registry().exporters); err != nil {
+			fmt.Fprintf(os.Stderr, "check failed: %s\n", err)
+			os.Exit(1)
 		}
-
-		e.bufQueueLength.With(labels).Set(float64(plugin.BufQueueLength))
-		e.bufTotalQueueSize.With(labels).Set(float64(plugin.BufTotalQueuedSize))
-		e.retryCount.With(labels).Set(float64(plugin.RetryCount))
+		return
 	}
-}
 
-type pluginsBody struct {
-	Plugins []plugin `json:"plugins"`
-}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := current.reload(); err != nil {
+				log.Errorf("Failed to reload, keeping the current exporter. %s", err)
+				continue
+			}
+			log.Info("Reloaded exporter")
+		}
+	}()
 
-type plugin struct {
-	PluginId           string `json:"plugin_id"`
-	PluginType         string `json:"type"`
-	OutputPlugin       bool `json:"output_plugin"`
-	BufQueueLength     float64 `json:"buffer_queue_length"`
-	BufTotalQueuedSize float64 `json:"buffer_total_queued_size"`
-	RetryCount         float64 `json:"retry_count"`
-}
+	if *srvName != "" {
+		go watchSRV(net.LookupSRV, *srvName, *srvInterval, current)
+	}
 
-func main() {
-	flag.Parse()
+	if *scrapeOnStart {
+		if err := initialScrape(current.registry().exporters, *failOnStartError); err != nil {
+			log.Fatalf("Initial scrape failed. %s", err)
+		}
+	}
 
-	if *showVersion {
-		fmt.Printf("Fluentd monitor agent exporter v%s\n", VERSION)
-		return
+	if *statsdAddress != "" {
+		go runStatsd(*statsdAddress, *statsdInterval, current)
 	}
 
-	exporter := NewExporter(*endpoint, *namespace, *timeout)
-	prometheus.MustRegister(exporter)
+	if *otlpEndpoint != "" {
+		go runOTLP(*otlpEndpoint, *otlpInterval, current)
+	}
 
-	http.Handle(*metricPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-<head><title>Fluentd monitor agent exporter</title></head>
-<body>
-<h1>Fluentd monitor agent exporter</h1>
-<p><a href='` + *metricPath + `'>Metrics</a></p>
-</body>
-</html>`))
-	})
+	if *textfileOutput != "" {
+		if len(listenAddress.addresses()) == 0 {
+			log.Infof("writing metrics to %s every %s", *textfileOutput, *textfileInterval)
+			runTextfile(*textfileOutput, *textfileInterval, current.exporterMetrics())
+			return
+		}
+		go runTextfile(*textfileOutput, *textfileInterval, current.exporterMetrics())
+	}
 
-	log.Infof("providing metrics at %s%s", *listenAddress, *metricPath)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	metricsURL, err := routes(http.DefaultServeMux, *routePrefix, current)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addrs := listenAddress.addresses()
+	for _, addr := range addrs {
+		log.Infof("providing metrics at %s%s", addr, metricsURL)
+	}
+	if err := serve(addrs, newServer); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const pluginsJSON = `{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":3,"buffer_total_queued_size":2048,"retry_count":1}]}`
+
+// newAgent starts a mock monitor agent answering /api/plugins.json with
+// pluginsJSON.
+func newAgent() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/plugins.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, pluginsJSON)
+	}))
+}
+
+func testOpts(endpoint string) collector.ExporterOpts {
+	return collector.ExporterOpts{
+		Endpoints: []string{endpoint},
+		Namespace: "fluentd",
+		Timeout:   time.Second,
+		Metrics:   []string{"buffer_queue_length"},
+	}
+}
+
+func newTestExporter(t *testing.T, endpoint string) *collector.Exporter {
+	e, err := collector.NewExporter(testOpts(endpoint))
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	return e
+}
+
+// downURL returns the URL of a server that is no longer listening.
+func downURL() string {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s.URL
+}
+
+func TestInitialScrape(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	opts := testOpts(agent.URL)
+	// Gathering the metrics would scrape again without the cache, so they
+	// come from initialScrape.
+	opts.CacheTTL = time.Hour
+	e, err := collector.NewExporter(opts)
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+
+	if err := initialScrape([]*collector.Exporter{e}, true); err != nil {
+		t.Fatalf("initialScrape: %s", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP fluentd_buffer_queue_length Number of chunks queued for flushing in the plugin's buffer (buffer_queue_length).
+# TYPE fluentd_buffer_queue_length gauge
+fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker=""} 3
+# HELP fluentd_scrapes_total Total number of times Fluentd was scraped for metrics.
+# TYPE fluentd_scrapes_total counter
+fluentd_scrapes_total 1
+`), "fluentd_buffer_queue_length", "fluentd_scrapes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInitialScrapeFailure(t *testing.T) {
+	e := newTestExporter(t, downURL())
+	if err := initialScrape([]*collector.Exporter{e}, true); err == nil {
+		t.Error("initialScrape of an unreachable agent succeeded with failOnError")
+	}
+	if err := initialScrape([]*collector.Exporter{e}, false); err != nil {
+		t.Errorf("initialScrape without failOnError returned %s", err)
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	current, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts(agent.URL)}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	metricsURL, err := routes(mux, "/fluentd-exporter/", current)
+	if err != nil {
+		t.Fatalf("routes: %s", err)
+	}
+	if metricsURL != "/fluentd-exporter/metrics" {
+		t.Errorf("metrics at %s, want /fluentd-exporter/metrics", metricsURL)
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := get("/fluentd-exporter/metrics"); code != 200 || !strings.Contains(body, "fluentd_buffer_queue_length") {
+		t.Errorf("GET /fluentd-exporter/metrics: %d\n%s", code, body)
+	}
+	if code, body := get("/fluentd-exporter/"); code != 200 || !strings.Contains(body, "href='/fluentd-exporter/metrics'") {
+		t.Errorf("landing page doesn't link to the prefixed metrics: %d\n%s", code, body)
+	}
+	if code, _ := get("/metrics"); code != 404 {
+		t.Errorf("GET /metrics outside the prefix: %d, want 404", code)
+	}
+
+	if _, err := routes(http.NewServeMux(), "fluentd-exporter", current); err == nil {
+		t.Error("routes accepted a prefix without a leading /")
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	text, err := versionString("text")
+	if err != nil || text != "Fluentd monitor agent exporter v" + VERSION + "\n" {
+		t.Errorf("versionString(text) = %q, %v", text, err)
+	}
+
+	out, err := versionString("json")
+	if err != nil {
+		t.Fatalf("versionString(json): %s", err)
+	}
+	var v map[string]string
+	if err := json.Unmarshal([]byte(out), &v); err != nil {
+		t.Fatalf("versionString(json) = %q, not JSON: %s", out, err)
+	}
+	if v["version"] != VERSION || v["revision"] != REVISION || v["goVersion"] != runtime.Version() {
+		t.Errorf("versionString(json) = %v", v)
+	}
+
+	if _, err := versionString("yaml"); err == nil {
+		t.Error("versionString accepted -output=yaml")
+	}
+}
+
+// listenConsecutive returns listeners on n consecutive ports of 127.0.0.1.
+func listenConsecutive(t *testing.T, n int) []net.Listener {
+	for attempt := 0; attempt < 20; attempt++ {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := first.Addr().(*net.TCPAddr).Port
+		listeners := []net.Listener{first}
+		for i := 1; i < n; i++ {
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port + i))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		if len(listeners) == n {
+			return listeners
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", n)
+	return nil
+}
+
+func TestWorkerPortRange(t *testing.T) {
+	listeners := listenConsecutive(t, 2)
+	for i, l := range listeners {
+		queue := i + 1
+		agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"plugins":[{"plugin_id":"out_s3","type":"s3","output_plugin":true,"buffer_queue_length":%d,"retry_count":0}]}`, queue)
+		}))
+		agent.Listener.Close()
+		agent.Listener = l
+		agent.Start()
+		defer agent.Close()
+	}
+	first := listeners[0].Addr().(*net.TCPAddr).Port
+
+	endpoints, workers, err := expandPortRange(fmt.Sprintf("http://127.0.0.1:%d", first), fmt.Sprintf("%d-%d", first, first + 1))
+	if err != nil {
+		t.Fatalf("expandPortRange: %s", err)
+	}
+	opts := testOpts("")
+	opts.Endpoints, opts.WorkerLabels = endpoints, workers
+	e, err := collector.NewExporter(opts)
+	if err != nil {
+		t.Fatalf("NewExporter: %s", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP fluentd_buffer_queue_length Number of chunks queued for flushing in the plugin's buffer (buffer_queue_length).
+# TYPE fluentd_buffer_queue_length gauge
+fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker="0"} 1
+fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",worker="1"} 2
+`), "fluentd_buffer_queue_length"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpandPortRangeInvalid(t *testing.T) {
+	for _, portRange := range []string{"24220", "24220-", "a-b", "0-2", "24223-24220", "65535-65536"} {
+		if _, _, err := expandPortRange("http://127.0.0.1:24220", portRange); err == nil {
+			t.Errorf("expandPortRange accepted %q", portRange)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	up := newTestExporter(t, agent.URL)
+	down := newTestExporter(t, downURL())
+
+	if err := check([]*collector.Exporter{up}); err != nil {
+		t.Errorf("check of a reachable agent: %s", err)
+	}
+	if err := check([]*collector.Exporter{up, down}); err == nil {
+		t.Error("check succeeded with an unreachable agent")
+	}
+}
+
+func TestWorkerPortRangeWithTargets(t *testing.T) {
+	old := []string{*workerPortRange, *configFile, *targetEndpoints}
+	defer func() { *workerPortRange, *configFile, *targetEndpoints = old[0], old[1], old[2] }()
+
+	*workerPortRange = "24220-24221"
+	for _, flags := range [][2]string{
+		{"fluentd.yml", ""},
+		{"", "http://10.0.0.1:24220,http://10.0.0.2:24220"},
+	} {
+		*configFile, *targetEndpoints = flags[0], flags[1]
+		if _, _, err := loadTargets(); err == nil || !strings.Contains(err.Error(), "-fluentd.worker-port-range") {
+			t.Errorf("loadTargets with -config.file=%q -fluentd.endpoints=%q returned %v, want the port range rejected", flags[0], flags[1], err)
+		}
+	}
+}
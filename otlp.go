@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// The OTLP/HTTP JSON encoding of an ExportMetricsServiceRequest, limited to
+// what the exporter sends: gauges and cumulative monotonic sums of doubles.
+// 64-bit integers are strings and enums numbers, as in the protobuf JSON
+// mapping OTLP uses.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpMetric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description,omitempty"`
+		Gauge       *otlpGauge `json:"gauge,omitempty"`
+		Sum         *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string             `json:"key"`
+		Value otlpAttributeValue `json:"value"`
+	}
+	otlpAttributeValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+// otlpMetrics converts the gathered counters and gauges to OTLP metrics:
+// gauges and untyped metrics to gauges, counters to cumulative monotonic sums
+// started at start. Labels become attributes. Histograms and summaries are
+// left out, as are NaN and infinite values, which JSON can't hold.
+func otlpMetrics(g prometheus.Gatherer, start, now time.Time) ([]otlpMetric, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	startNano, nowNano := otlpTime(start), otlpTime(now)
+	var metrics []otlpMetric
+	for _, mf := range mfs {
+		var points []otlpDataPoint
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			p := otlpDataPoint{TimeUnixNano: nowNano, AsDouble: value}
+			for _, l := range m.GetLabel() {
+				p.Attributes = append(p.Attributes, otlpAttribute{l.GetName(), otlpAttributeValue{l.GetValue()}})
+			}
+			if mf.GetType() == dto.MetricType_COUNTER {
+				p.StartTimeUnixNano = startNano
+			}
+			points = append(points, p)
+		}
+		if len(points) == 0 {
+			continue
+		}
+
+		metric := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			metric.Sum = &otlpSum{DataPoints: points, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		} else {
+			metric.Gauge = &otlpGauge{DataPoints: points}
+		}
+		metrics = append(metrics, metric)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics, nil
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// pushOTLP sends the gathered metrics to the OTLP/HTTP receiver at endpoint,
+// e.g. http://localhost:4318, as JSON. start is when the counters started.
+func pushOTLP(client *http.Client, endpoint string, g prometheus.Gatherer, start time.Time) error {
+	metrics, err := otlpMetrics(g, start, time.Now())
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(otlpRequest{[]otlpResourceMetrics{{
+		Resource: otlpResource{[]otlpAttribute{
+			{"service.name", otlpAttributeValue{"fluentd_monitor_agent_exporter"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{"fluentd_monitor_agent_exporter", VERSION},
+			Metrics: metrics,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Post(strings.TrimRight(endpoint, "/") + "/v1/metrics", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, res.Body)
+	if !(res.StatusCode >= 200 && res.StatusCode < 300) {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// pushCurrentOTLP pushes the metrics of the current exporters of r to
+// endpoint. A reload starts the counters over, so they start when the
+// current registry was built.
+func pushCurrentOTLP(client *http.Client, endpoint string, r *reloader) error {
+	reg := r.registry()
+	return pushOTLP(client, endpoint, reg.gatherer, reg.created)
+}
+
+// runOTLP pushes the metrics of r to endpoint every interval, forever.
+func runOTLP(endpoint string, interval time.Duration, r *reloader) {
+	client := &http.Client{Timeout: interval}
+	for {
+		if err := pushCurrentOTLP(client, endpoint, r); err != nil {
+			log.Errorf("Failed to push metrics to %s. %s", endpoint, err)
+		}
+		time.Sleep(interval)
+	}
+}
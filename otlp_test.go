@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushOTLP(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %s", err)
+		}
+		received <- req
+	}))
+	defer receiver.Close()
+
+	reg := prometheus.NewRegistry()
+	queue := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_buffer_queue_length", Help: "Queue length."}, []string{"pluginId"})
+	queue.WithLabelValues("out_s3").Set(3)
+	queue.WithLabelValues("out_unknown").Set(math.NaN())
+	scrapes := prometheus.NewCounter(prometheus.CounterOpts{Name: "fluentd_scrapes_total", Help: "Scrapes."})
+	scrapes.Add(2)
+	wait := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "fluentd_collect_lock_wait_seconds", Help: "Wait."})
+	wait.Observe(1)
+	reg.MustRegister(queue, scrapes, wait)
+
+	start := time.Unix(1500000000, 0)
+	if err := pushOTLP(http.DefaultClient, receiver.URL + "/", reg, start); err != nil {
+		t.Fatalf("pushOTLP: %s", err)
+	}
+	req := <-received
+	if len(req.ResourceMetrics) != 1 || len(req.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("got %+v", req)
+	}
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Fatalf("got %d metrics, want the gauge and the counter without the histogram: %+v", len(metrics), metrics)
+	}
+
+	gauge := metrics[0]
+	if gauge.Name != "fluentd_buffer_queue_length" || gauge.Gauge == nil || len(gauge.Gauge.DataPoints) != 1 {
+		t.Fatalf("got %+v, want a gauge without the NaN point", gauge)
+	}
+	p := gauge.Gauge.DataPoints[0]
+	if p.AsDouble != 3 || len(p.Attributes) != 1 || p.Attributes[0].Key != "pluginId" || p.Attributes[0].Value.StringValue != "out_s3" {
+		t.Errorf("got data point %+v", p)
+	}
+
+	sum := metrics[1]
+	if sum.Name != "fluentd_scrapes_total" || sum.Sum == nil || !sum.Sum.IsMonotonic || sum.Sum.AggregationTemporality != otlpCumulative {
+		t.Fatalf("got %+v, want a cumulative monotonic sum", sum)
+	}
+	if p := sum.Sum.DataPoints[0]; p.AsDouble != 2 || p.StartTimeUnixNano != "1500000000000000000" {
+		t.Errorf("got data point %+v", p)
+	}
+}
+
+func TestPushOTLPStartAfterReload(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	received := make(chan otlpRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %s", err)
+		}
+		received <- req
+	}))
+	defer receiver.Close()
+
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts(agent.URL)}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	// startOf returns the start time of the first counter pushed.
+	startOf := func() string {
+		if err := pushCurrentOTLP(http.DefaultClient, receiver.URL, r); err != nil {
+			t.Fatalf("pushCurrentOTLP: %s", err)
+		}
+		req := <-received
+		for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			if m.Sum != nil {
+				return m.Sum.DataPoints[0].StartTimeUnixNano
+			}
+		}
+		t.Fatal("no counter pushed")
+		return ""
+	}
+
+	before := startOf()
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if after, want := startOf(), otlpTime(r.registry().created); after == before || after != want {
+		t.Errorf("got start %s after the reload, want %s rather than %s", after, want, before)
+	}
+}
+
+func TestPushOTLPStatus(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	if err := pushOTLP(http.DefaultClient, receiver.URL, prometheus.NewRegistry(), time.Now()); err == nil {
+		t.Error("pushOTLP succeeded against a failing receiver")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/be-hase/fluentd_monitor_agent_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// processStart is exposed as exporter_start_time_seconds, unchanged by reloads.
+var processStart = time.Now()
+
+// registry is one generation of the exporter: a fresh prometheus.Registry, the
+// Exporters registered on it and the handler serving it.
+type registry struct {
+	exporters []*collector.Exporter
+	targets   []target             // of exporters, by index
+	labels    []prometheus.Labels  // added to the metrics of exporters, by index; nil for unnamed targets
+	static    *prometheus.Registry // the metrics besides those of exporters
+	gatherer  prometheus.Gatherer  // of the metrics of exporters
+	handler   http.Handler
+	created   time.Time // when the counters of exporters started
+}
+
+// newRegistry registers an Exporter per target, labeling the metrics of named
+// targets with their name and labels. configMtime is exposed unless it is zero.
+func newRegistry(targets []target, configMtime time.Time) (*registry, error) {
+	static := prometheus.NewRegistry()
+	if err := static.Register(prometheus.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if err := static.Register(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *namespace,
+		Name:      "exporter_start_time_seconds",
+		Help:      "Start time of the exporter process as a Unix timestamp.",
+	})
+	startTime.Set(float64(processStart.UnixNano()) / 1e9)
+	if err := static.Register(startTime); err != nil {
+		return nil, err
+	}
+
+	if !configMtime.IsZero() {
+		mtime := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: *namespace,
+			Name:      "config_file_mtime_seconds",
+			Help:      "Modification time of -config.file when it was last loaded.",
+		})
+		mtime.Set(float64(configMtime.UnixNano()) / 1e9)
+		if err := static.Register(mtime); err != nil {
+			return nil, err
+		}
+	}
+
+	// A metric needs the same label names on every target, so targets get
+	// the labels of the others too, empty, which Prometheus treats as unset.
+	labelNames := map[string]bool{}
+	for _, t := range targets {
+		for name := range t.labels {
+			labelNames[name] = true
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	var exporters []*collector.Exporter
+	var exporterLabels []prometheus.Labels
+	for _, t := range targets {
+		exporter, err := collector.NewExporter(t.opts)
+		if err != nil {
+			if t.name != "" {
+				return nil, fmt.Errorf("target %q: %s", t.name, err)
+			}
+			return nil, err
+		}
+
+		var r prometheus.Registerer = reg
+		var labels prometheus.Labels
+		if t.name != "" {
+			labels = prometheus.Labels{"target": t.name}
+			for name := range labelNames {
+				labels[name] = t.labels[name]
+			}
+			for _, name := range exporter.LabelNames() {
+				if _, ok := t.labels[name]; ok {
+					return nil, fmt.Errorf("target %q: label %q is already a label of the exporter's metrics", t.name, name)
+				}
+			}
+			r = prometheus.WrapRegistererWith(labels, reg)
+		}
+		if err := r.Register(exporter); err != nil {
+			if t.name != "" {
+				return nil, fmt.Errorf("target %q: %s", t.name, err)
+			}
+			return nil, err
+		}
+		exporters = append(exporters, exporter)
+		exporterLabels = append(exporterLabels, labels)
+	}
+
+	r := &registry{
+		exporters: exporters,
+		targets:   targets,
+		labels:    exporterLabels,
+		static:    static,
+		gatherer:  reg,
+		created:   time.Now(),
+	}
+	r.handler = promhttp.InstrumentMetricHandler(static, limitRequests(*maxRequests, http.HandlerFunc(r.serveMetrics)))
+	return r, nil
+}
+
+// serveMetrics serves the metrics of a registry of its own, on which the
+// exporters are registered bound to the request's context. A client giving up
+// on the request thereby cancels the scrapes of Fluentd only it waits for.
+func (r *registry) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	reg := prometheus.NewRegistry()
+	for i, exporter := range r.exporters {
+		var registerer prometheus.Registerer = reg
+		if r.labels[i] != nil {
+			registerer = prometheus.WrapRegistererWith(r.labels[i], reg)
+		}
+		// Registered the same way by newRegistry, so this doesn't fail.
+		if err := registerer.Register(exporter.WithContext(req.Context())); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	promhttp.HandlerFor(prometheus.Gatherers{r.static, reg}, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
+
+// limitRequests answers requests beyond max concurrent ones with 503, like
+// promhttp.HandlerOpts.MaxRequestsInFlight does. Unlimited when max is 0.
+func limitRequests(max int, h http.Handler) http.Handler {
+	if max <= 0 {
+		return h
+	}
+	inFlight := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", max), http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// reloader serves and gathers from the current registry. reload builds a new
+// registry and atomically swaps it in, so series of the previous generation
+// vanish entirely instead of lingering in shared collectors.
+type reloader struct {
+	load    func() ([]target, time.Time, error)
+	current atomic.Value // *registry
+}
+
+func newReloader(load func() ([]target, time.Time, error)) (*reloader, error) {
+	r := &reloader{load: load}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload replaces the current registry. On error the current one is kept.
+func (r *reloader) reload() error {
+	return r.reloadWith(r.load)
+}
+
+// reloadWith is reload with the targets of load instead of r's.
+func (r *reloader) reloadWith(load func() ([]target, time.Time, error)) error {
+	targets, configMtime, err := load()
+	if err != nil {
+		return err
+	}
+	reg, err := newRegistry(targets, configMtime)
+	if err != nil {
+		return err
+	}
+	r.current.Store(reg)
+	return nil
+}
+
+func (r *reloader) registry() *registry {
+	return r.current.Load().(*registry)
+}
+
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.registry().handler.ServeHTTP(w, req)
+}
+
+func (r *reloader) Gather() ([]*dto.MetricFamily, error) {
+	reg := r.registry()
+	return prometheus.Gatherers{reg.static, reg.gatherer}.Gather()
+}
+
+// exporterMetrics returns a Gatherer of the metrics of the current exporters
+// only, without the Go, process and other static ones. node_exporter has the
+// Go and process metrics itself and refuses textfiles repeating them.
+func (r *reloader) exporterMetrics() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return r.registry().gatherer.Gather()
+	})
+}
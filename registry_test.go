@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scrapeBody returns the response of h to GET /metrics.
+func scrapeBody(t *testing.T, h *reloader) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("GET /metrics: %d %s", rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func TestReloadDropsPreviousSeries(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+
+	metrics := []string{"buffer_queue_length"}
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		opts := testOpts(agent.URL)
+		opts.Metrics = metrics
+		return []target{{opts: opts}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	if body := scrapeBody(t, r); !strings.Contains(body, "fluentd_buffer_queue_length{") {
+		t.Fatalf("buffer_queue_length not exposed before the reload:\n%s", body)
+	}
+
+	metrics = []string{"retry_count"}
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	body := scrapeBody(t, r)
+	if strings.Contains(body, "fluentd_buffer_queue_length{") {
+		t.Errorf("series of the previous generation survived the reload:\n%s", body)
+	}
+	if !strings.Contains(body, "fluentd_retry_count{") {
+		t.Errorf("series of the new generation are missing:\n%s", body)
+	}
+}
+
+func TestReloadRemovesTarget(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+
+	targets := []target{
+		{name: "keep", opts: testOpts(agent.URL)},
+		{name: "removed", opts: testOpts(agent.URL)},
+	}
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return targets, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	if body := scrapeBody(t, r); !strings.Contains(body, `target="removed"`) {
+		t.Fatalf("target removed not scraped before the reload:\n%s", body)
+	}
+
+	targets = targets[:1]
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	body := scrapeBody(t, r)
+	if strings.Contains(body, `target="removed"`) {
+		t.Errorf("series of the removed target survived the reload:\n%s", body)
+	}
+	if !strings.Contains(body, `target="keep"`) {
+		t.Errorf("series of the kept target are missing:\n%s", body)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	fetched, release := make(chan struct{}, 1), make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		<-release
+		fmt.Fprint(w, pluginsJSON)
+	}))
+	defer agent.Close()
+
+	old := *maxRequests
+	*maxRequests = 1
+	defer func() { *maxRequests = old }()
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts(agent.URL)}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+
+	first := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		first <- rec.Code
+	}()
+	<-fetched
+
+	// Rejected right away, without waiting for the scrape in flight.
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request beyond -web.max-requests: %d, want 503", rec.Code)
+	}
+
+	close(release)
+	if code := <-first; code != 200 {
+		t.Errorf("request within -web.max-requests: %d, want 200", code)
+	}
+}
+
+func TestClientDisconnectCancelsScrape(t *testing.T) {
+	fetched, canceled := make(chan struct{}), make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetched)
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer agent.Close()
+
+	// Well above the wait below, so the connection deadline can't be what
+	// ends the fetch.
+	opts := testOpts(agent.URL)
+	opts.Timeout = 10 * time.Second
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: opts}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+		close(served)
+	}()
+	<-fetched
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fetch from the agent not canceled after the client went away")
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request still served after the client went away")
+	}
+}
+
+func TestExporterStartTime(t *testing.T) {
+	// As if the process started now.
+	old := processStart
+	processStart = time.Now()
+	defer func() { processStart = old }()
+
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts("http://127.0.0.1:24220")}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	start, ok := gaugeValue(t, r, "fluentd_exporter_start_time_seconds")
+	now := float64(time.Now().UnixNano()) / 1e9
+	if !ok || start > now || now - start > 1 {
+		t.Errorf("exporter_start_time_seconds = %g (%t), want within a second before %g", start, ok, now)
+	}
+
+	// Reloads don't restart the process.
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if v, _ := gaugeValue(t, r, "fluentd_exporter_start_time_seconds"); v != start {
+		t.Errorf("exporter_start_time_seconds after a reload = %g, want %g", v, start)
+	}
+}
+
+func TestLockTimeoutPerRequest(t *testing.T) {
+	var slow int32
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		fmt.Fprint(w, pluginsJSON)
+	}))
+	defer agent.Close()
+	defer close(release)
+
+	opts := testOpts(agent.URL)
+	opts.LockTimeout = 50 * time.Millisecond
+	r, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{name: "aggregator-1", opts: opts}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	scrapeBody(t, r)
+
+	atomic.StoreInt32(&slow, 1)
+	body := scrapeBody(t, r)
+	if !strings.Contains(body, `fluentd_last_scrape_error{target="aggregator-1"} 1`) {
+		t.Errorf("request that timed out doesn't report it:\n%s", body)
+	}
+	if !strings.Contains(body, `fluentd_buffer_queue_length{pluginId="out_s3",pluginType="s3",target="aggregator-1",worker=""} 3`) {
+		t.Errorf("request that timed out lacks the metrics of the last scrape:\n%s", body)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// shutdownTimeout bounds how long in-flight requests are given to finish once
+// the exporter is asked to stop.
+const shutdownTimeout = 5 * time.Second
+
+// listFlag is a flag that can be repeated. The first value given on the command
+// line replaces the defaults.
+type listFlag struct {
+	values []string
+	set    bool
+}
+
+func newListFlag(name string, defaults []string, usage string) *listFlag {
+	f := &listFlag{values: defaults}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *listFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	if !f.set {
+		f.values, f.set = nil, true
+	}
+	f.values = append(f.values, value)
+	return nil
+}
+
+// addresses returns the non-empty values.
+func (f *listFlag) addresses() []string {
+	var addrs []string
+	for _, v := range f.values {
+		if v != "" {
+			addrs = append(addrs, v)
+		}
+	}
+	return addrs
+}
+
+// newServer returns the server for addr, with the timeouts of the -web flags.
+func newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+}
+
+// serve runs a server per address until one of them fails or the process gets
+// SIGINT or SIGTERM, then shuts all of them down.
+func serve(addrs []string, newServer func(addr string) *http.Server) error {
+	servers := make([]*http.Server, len(addrs))
+	errs := make(chan error, len(addrs))
+	for i, addr := range addrs {
+		servers[i] = newServer(addr)
+		go func(s *http.Server) {
+			errs <- s.ListenAndServe()
+		}(servers[i])
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-stop:
+		log.Infof("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if shutdownErr := s.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewServerTimeouts(t *testing.T) {
+	defaults := newServer(":9224")
+	if defaults.Addr != ":9224" {
+		t.Errorf("Addr %q, want :9224", defaults.Addr)
+	}
+	for name, d := range map[string]time.Duration{
+		"ReadHeaderTimeout": defaults.ReadHeaderTimeout,
+		"ReadTimeout":       defaults.ReadTimeout,
+		"WriteTimeout":      defaults.WriteTimeout,
+		"IdleTimeout":       defaults.IdleTimeout,
+	} {
+		if d <= 0 {
+			t.Errorf("%s is %s by default, want a timeout", name, d)
+		}
+	}
+
+	old := []time.Duration{*readHeaderTimeout, *readTimeout, *writeTimeout, *idleTimeout}
+	defer func() {
+		*readHeaderTimeout, *readTimeout, *writeTimeout, *idleTimeout = old[0], old[1], old[2], old[3]
+	}()
+	*readHeaderTimeout, *readTimeout, *writeTimeout, *idleTimeout = time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second
+
+	s := newServer(":9224")
+	if s.ReadHeaderTimeout != time.Second || s.ReadTimeout != 2 * time.Second || s.WriteTimeout != 3 * time.Second || s.IdleTimeout != 4 * time.Second {
+		t.Errorf("got timeouts %s, %s, %s, %s, want the flags' 1s, 2s, 3s, 4s", s.ReadHeaderTimeout, s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	f := &listFlag{values: []string{":9121"}}
+	if got := f.addresses(); !reflect.DeepEqual(got, []string{":9121"}) {
+		t.Errorf("default addresses %v, want [:9121]", got)
+	}
+	for _, v := range []string{"127.0.0.1:9121", "", "10.0.0.1:9121"} {
+		f.Set(v)
+	}
+	if got := f.addresses(); !reflect.DeepEqual(got, []string{"127.0.0.1:9121", "10.0.0.1:9121"}) {
+		t.Errorf("addresses %v, want the given non-empty ones without the default", got)
+	}
+}
+
+// freeAddrs returns n distinct addresses of 127.0.0.1 that were free a moment
+// ago.
+func freeAddrs(t *testing.T, n int) []string {
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+	var addrs []string
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+	}
+	return addrs
+}
+
+func TestServeSeveralAddresses(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	var mu sync.Mutex
+	servers := map[string]*http.Server{}
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(addrs, func(addr string) *http.Server {
+			s := newServer(addr)
+			s.Handler = mux
+			mu.Lock()
+			servers[addr] = s
+			mu.Unlock()
+			return s
+		})
+	}()
+
+	for _, addr := range addrs {
+		var body []byte
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			res, err := http.Get("http://" + addr + "/metrics")
+			if err == nil {
+				body, _ = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never served: %s", addr, err)
+			}
+		}
+		if string(body) != "ok" {
+			t.Errorf("%s served %q", addr, body)
+		}
+	}
+
+	// One server stopping stops all of them.
+	mu.Lock()
+	servers[addrs[0]].Close()
+	mu.Unlock()
+	select {
+	case err := <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("serve returned %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve kept running after a server stopped")
+	}
+	if _, err := http.Get("http://" + addrs[1] + "/metrics"); err == nil {
+		t.Errorf("%s still serving after serve returned", addrs[1])
+	}
+}
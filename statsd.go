@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// statsdMaxPacket keeps pushed datagrams below the common Ethernet MTU.
+const statsdMaxPacket = 1400
+
+var statsdInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// statsdLines formats the gathered plugin metrics, the series carrying a plugin
+// id label, as StatsD gauges. Info metrics, whose values are always 1, are
+// left out, as are NaN and infinite values. The labels, ordered by name, are
+// appended to the metric name as name and value pairs, with "_" for an empty
+// value, e.g. fluentd_buffer_queue_length.pluginId.out_s3.pluginType.s3.worker._:3|g.
+//
+// A signed gauge value changes the gauge by that much instead of setting it,
+// so negative values are sent as a 0 followed by the value, both in one
+// element of the result, to be sent in the same packet.
+func statsdLines(g prometheus.Gatherer) ([]string, error) {
+	samples, err := gatherSamples(g)
+	if err != nil {
+		return nil, err
+	}
+
+	type gauge struct {
+		name  string
+		value float64
+	}
+	var gauges []gauge
+	for name, series := range samples {
+		if strings.HasSuffix(name, "_info") {
+			continue
+		}
+		for _, s := range series {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			if _, ok := s.Labels["pluginId"]; !ok {
+				if _, ok := s.Labels["plugin_id"]; !ok {
+					continue
+				}
+			}
+			var labelNames []string
+			for l := range s.Labels {
+				labelNames = append(labelNames, l)
+			}
+			sort.Strings(labelNames)
+
+			parts := []string{name}
+			for _, l := range labelNames {
+				v := statsdInvalidChars.ReplaceAllString(s.Labels[l], "_")
+				if v == "" {
+					v = "_"
+				}
+				parts = append(parts, l, v)
+			}
+			gauges = append(gauges, gauge{strings.Join(parts, "."), s.Value})
+		}
+	}
+
+	sort.Slice(gauges, func(i, j int) bool { return gauges[i].name < gauges[j].name })
+	var lines []string
+	for _, p := range gauges {
+		line := p.name + ":" + strconv.FormatFloat(p.value, 'f', -1, 64) + "|g"
+		if p.value < 0 {
+			line = p.name + ":0|g\n" + line
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// pushStatsd sends the gathered metrics to the StatsD server at addr over UDP.
+func pushStatsd(addr string, g prometheus.Gatherer) error {
+	lines, err := statsdLines(g)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len() + len(line) + 1 > statsdMaxPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+// runStatsd pushes the metrics to addr every interval, forever.
+func runStatsd(addr string, interval time.Duration, g prometheus.Gatherer) {
+	for {
+		if err := pushStatsd(addr, g); err != nil {
+			log.Errorf("Failed to push metrics to %s. %s", addr, err)
+		}
+		time.Sleep(interval)
+	}
+}
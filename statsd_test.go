@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reg := prometheus.NewRegistry()
+	queue := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_buffer_queue_length", Help: "Queue length."}, []string{"pluginId", "pluginType", "worker"})
+	queue.WithLabelValues("out_s3", "s3", "").Set(3)
+	queue.WithLabelValues("out.forward@1", "forward", "0").Set(1.5)
+	queue.WithLabelValues("out_unknown", "s3", "").Set(math.NaN())
+	size := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_buffer_total_queued_size", Help: "Queued size."}, []string{"pluginId"})
+	size.WithLabelValues("out_s3").Set(2.5e9)
+	growth := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_buffer_queued_size_growth_bytes_per_second", Help: "Growth."}, []string{"pluginId"})
+	growth.WithLabelValues("out_s3").Set(-1024.5)
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_plugin_info", Help: "Plugin info."}, []string{"pluginId"})
+	info.WithLabelValues("out_s3").Set(1)
+	scrapes := prometheus.NewCounter(prometheus.CounterOpts{Name: "fluentd_scrapes_total", Help: "Scrapes."})
+	scrapes.Inc()
+	reg.MustRegister(queue, size, growth, info, scrapes)
+
+	if err := pushStatsd(conn.LocalAddr().String(), reg); err != nil {
+		t.Fatalf("pushStatsd: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, statsdMaxPacket)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %s", err)
+	}
+	// A negative gauge is reset to 0 first, as a signed value is a change.
+	want := "fluentd_buffer_queue_length.pluginId.out_forward_1.pluginType.forward.worker.0:1.5|g\n" +
+		"fluentd_buffer_queue_length.pluginId.out_s3.pluginType.s3.worker._:3|g\n" +
+		"fluentd_buffer_queued_size_growth_bytes_per_second.pluginId.out_s3:0|g\n" +
+		"fluentd_buffer_queued_size_growth_bytes_per_second.pluginId.out_s3:-1024.5|g\n" +
+		"fluentd_buffer_total_queued_size.pluginId.out_s3:2500000000|g\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got packet\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPushStatsdSplitsPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reg := prometheus.NewRegistry()
+	queue := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_buffer_queue_length", Help: "Queue length."}, []string{"pluginId"})
+	for i := 0; i < 100; i++ {
+		queue.WithLabelValues(strings.Repeat("x", i + 1)).Set(1)
+	}
+	reg.MustRegister(queue)
+
+	if err := pushStatsd(conn.LocalAddr().String(), reg); err != nil {
+		t.Fatalf("pushStatsd: %s", err)
+	}
+	buf := make([]byte, 65536)
+	lines := 0
+	for lines < 100 {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d of 100 lines: %s", lines, err)
+		}
+		if n > statsdMaxPacket {
+			t.Errorf("packet of %d bytes, over %d", n, statsdMaxPacket)
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// writeTextfile writes the gathered metrics to path in the Prometheus text
+// format, for node_exporter's textfile collector. The file is written to a
+// temporary file in the same directory and renamed, so readers never see a
+// partial file.
+func writeTextfile(path string, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(tmp, mf); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// runTextfile calls writeTextfile every interval, forever.
+func runTextfile(path string, interval time.Duration, g prometheus.Gatherer) {
+	for {
+		if err := writeTextfile(path, g); err != nil {
+			log.Errorf("Failed to write textfile %s. %s", path, err)
+		}
+		time.Sleep(interval)
+	}
+}
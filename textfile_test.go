@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	queue := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fluentd_buffer_queue_length", Help: "Queue length."}, []string{"pluginId"})
+	queue.WithLabelValues("out_s3").Set(3)
+	reg.MustRegister(queue)
+
+	path := filepath.Join(dir, "fluentd.prom")
+	if err := writeTextfile(path, reg); err != nil {
+		t.Fatalf("writeTextfile: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		t.Fatalf("written file doesn't parse: %s", err)
+	}
+	mf, ok := mfs["fluentd_buffer_queue_length"]
+	if !ok || len(mf.GetMetric()) != 1 || mf.GetMetric()[0].GetGauge().GetValue() != 3 {
+		t.Errorf("got %v, want fluentd_buffer_queue_length 3", mfs)
+	}
+
+	// The temporary file was renamed, not left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range files {
+		if strings.Contains(info.Name(), ".tmp") {
+			t.Errorf("temporary file %s left behind", info.Name())
+		}
+	}
+}
+
+func TestTextfileExporterMetricsOnly(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	current, err := newReloader(func() ([]target, time.Time, error) {
+		return []target{{opts: testOpts(agent.URL)}}, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatalf("newReloader: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fluentd.prom")
+	if err := writeTextfile(path, current.exporterMetrics()); err != nil {
+		t.Fatalf("writeTextfile: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		t.Fatalf("written file doesn't parse: %s", err)
+	}
+	if _, ok := mfs["fluentd_buffer_queue_length"]; !ok {
+		t.Error("fluentd_buffer_queue_length not written")
+	}
+	// node_exporter has these itself, and refuses files with them.
+	for name := range mfs {
+		for _, prefix := range []string{"go_", "process_", "promhttp_", "fluentd_exporter_start_time_seconds"} {
+			if strings.HasPrefix(name, prefix) {
+				t.Errorf("%s written", name)
+			}
+		}
+	}
+}
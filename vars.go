@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// sample is one series in the -web.vars-path output.
+type sample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// gatherSamples returns the series of the gathered counters and gauges by
+// metric name. Histograms and summaries are left out.
+func gatherSamples(g prometheus.Gatherer) (map[string][]sample, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := map[string][]sample{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			samples[mf.GetName()] = append(samples[mf.GetName()], sample{labels, value})
+		}
+	}
+	return samples, nil
+}
+
+// varsHandler serves the gathered counters and gauges as expvar-style JSON,
+// an object mapping every metric name to its series, for consumers that don't
+// speak the Prometheus formats.
+func varsHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars, err := gatherSamples(g)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(vars); err != nil {
+			log.Errorf("Failed to write %s. %s", r.URL.Path, err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestVarsHandler(t *testing.T) {
+	agent := newAgent()
+	defer agent.Close()
+	e := newTestExporter(t, agent.URL)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	rec := httptest.NewRecorder()
+	varsHandler(reg).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var vars map[string][]sample
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("not JSON: %s\n%s", err, rec.Body)
+	}
+
+	want := []sample{{Labels: map[string]string{"pluginId": "out_s3", "pluginType": "s3", "worker": ""}, Value: 3}}
+	if got := vars["fluentd_buffer_queue_length"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("fluentd_buffer_queue_length = %+v, want %+v", got, want)
+	}
+	if got := vars["fluentd_last_scrape_error"]; len(got) != 1 || got[0].Value != 0 {
+		t.Errorf("fluentd_last_scrape_error = %+v, want 0", got)
+	}
+	// Histograms are left out.
+	if got, ok := vars["fluentd_collect_lock_wait_seconds"]; ok {
+		t.Errorf("got histogram collect_lock_wait_seconds %+v", got)
+	}
+}